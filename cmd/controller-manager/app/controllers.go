@@ -324,7 +324,10 @@ func addAllControllers(mgr manager.Manager, client k8s.Client, informerFactory i
 
 	// "hpa" controller
 	if cmOptions.IsControllerEnabled("hpa") {
-		hpaController := hpa.NewHPAController(kubernetesInformer.Autoscaling().V2().HorizontalPodAutoscalers(), client.Kubernetes())
+		hpaController, err := hpa.NewHPAControllerWithDiscovery(kubernetesInformer, client.Kubernetes())
+		if err != nil {
+			return err
+		}
 		addController(mgr, "hpa", hpaController)
 	}
 
@@ -333,7 +336,6 @@ func addAllControllers(mgr manager.Manager, client k8s.Client, informerFactory i
 		jobController := job.NewJobController(kubernetesInformer.Batch().V1().Jobs(), client.Kubernetes())
 		addController(mgr, "job", jobController)
 	}
-	kubernetesInformer.Autoscaling().V2().HorizontalPodAutoscalers()
 	// "storagecapability" controller
 	if cmOptions.IsControllerEnabled("storagecapability") {
 		storageCapabilityController := capability.NewController(
@@ -0,0 +1,755 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// writtenAnnotationsAnnotation records the JSON list of the annotation keys last written by this controller.
+const writtenAnnotationsAnnotation = "autoscaling.kubesphere.io/written-annotations"
+
+// lastReconcileTimeAnnotation records the time of the last sync which changed the annotations.
+const lastReconcileTimeAnnotation = "lastReconcileTime"
+
+// managedAnnotationKeys are the annotation keys written by this controller,
+// only these keys, or keys of the form "<key>.<suffix>", will be removed
+// when they are no longer applicable.
+var managedAnnotationKeys = []string{
+	"cpuTargetUtilization",
+	"cpuTargetValue",
+	"memoryTargetUtilization",
+	"memoryTargetValue",
+	"podsMetric",
+	"objectMetric",
+	"objectMetricTarget",
+	"externalMetric",
+	"externalMetricSelector",
+	"podsMetricSelector",
+	"objectMetricSelector",
+	"minReplicas",
+	"maxReplicas",
+	"currentReplicas",
+	"desiredReplicas",
+	"lastScaleTime",
+	"scaleTargetRef",
+	"scalingActive",
+	"ableToScale",
+	"targetMissing",
+	"scalingThrash",
+	"metricsSummary",
+	"targetOutOfRange",
+	"currentCpuUtilization",
+	"currentCpuValue",
+	"currentMemoryUtilization",
+	"currentMemoryValue",
+	"currentPodsMetric",
+	"currentObjectMetric",
+	"currentExternalMetric",
+	"cpuCurrentUtilization",
+	"memoryCurrentUsage",
+	"scaleUpStabilizationWindowSeconds",
+	"scaleDownStabilizationWindowSeconds",
+	"scaleUpPolicies",
+	"scaleDownPolicies",
+	lastReconcileTimeAnnotation,
+	"atMaxReplicas",
+	"metricCount",
+	"generationLag",
+	"atMinReplicas",
+	"cpuRequest",
+	"replicaRange",
+	"scaleUpSelectPolicy",
+	"scaleDownSelectPolicy",
+}
+
+// statusAnnotationKeys are the managed annotation keys, or key prefixes, of the values observed by the
+// autoscaler and the metrics API, they change on most of the syncs.
+var statusAnnotationKeys = []string{
+	"currentReplicas",
+	"desiredReplicas",
+	"currentCpuUtilization",
+	"currentCpuValue",
+	"currentMemoryUtilization",
+	"currentMemoryValue",
+	"currentPodsMetric",
+	"currentObjectMetric",
+	"currentExternalMetric",
+	"cpuCurrentUtilization",
+	"memoryCurrentUsage",
+}
+
+// statusOnlyPatch returns true if the patch only changes the status annotations, the bookkeeping
+// annotations of the controller aside.
+func (v *HPAController) statusOnlyPatch(patch map[string]interface{}) bool {
+	for key := range patch {
+		if key == writtenAnnotationsAnnotation || key == v.annotationPrefix+lastReconcileTimeAnnotation {
+			continue
+		}
+		if !strings.HasPrefix(key, v.annotationPrefix) || !hasKey(statusAnnotationKeys, strings.TrimPrefix(key, v.annotationPrefix)) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasKey returns true if key is one of keys, or of the form "<key>.<suffix>".
+func hasKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if key == k || strings.HasPrefix(key, k+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// isManagedAnnotation returns true if the annotation key is written by this controller.
+func (v *HPAController) isManagedAnnotation(key string) bool {
+	if !strings.HasPrefix(key, v.annotationPrefix) {
+		return false
+	}
+	key = strings.TrimPrefix(key, v.annotationPrefix)
+
+	for _, managed := range managedAnnotationKeys {
+		if key == managed || strings.HasPrefix(key, managed+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedAnnotation returns true if the annotation key, with or without the prefix, is excluded.
+func (v *HPAController) excludedAnnotation(key string) bool {
+	if v.excludedKeys.Len() == 0 {
+		return false
+	}
+	return v.excludedKeys.Has(key) || v.excludedKeys.Has(strings.TrimPrefix(key, v.annotationPrefix))
+}
+
+// annotationsPatch returns the annotations which should be merged into the existing ones,
+// a nil value means the annotation is managed by us but no longer applicable and should be removed.
+// The keys of desired are recorded in writtenAnnotationsAnnotation, so the next patch only prunes
+// the keys we have written, including the ones of the enricher.
+func (v *HPAController) annotationsPatch(existing, desired map[string]string) map[string]interface{} {
+	patch := make(map[string]interface{})
+
+	for _, key := range v.writtenAnnotations(existing) {
+		if _, ok := desired[key]; ok || v.excludedAnnotation(key) {
+			continue
+		}
+		if _, ok := existing[key]; ok {
+			patch[key] = nil
+		}
+	}
+
+	for key, value := range desired {
+		if current, ok := existing[key]; !ok || current != value {
+			patch[key] = value
+		}
+	}
+
+	if !v.recordedAnnotations(existing, desired) {
+		if written, err := writtenAnnotationsValue(desired); err == nil {
+			patch[writtenAnnotationsAnnotation] = written
+		}
+	}
+
+	return patch
+}
+
+// writtenAnnotationsValue returns the value of writtenAnnotationsAnnotation recording the keys of desired.
+func writtenAnnotationsValue(desired map[string]string) (string, error) {
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	written, err := json.Marshal(keys)
+	return string(written), err
+}
+
+// recordedAnnotations returns true if writtenAnnotationsAnnotation already records exactly the keys
+// of desired, in any order, so a list written in another order doesn't cause an update.
+func (v *HPAController) recordedAnnotations(existing, desired map[string]string) bool {
+	var keys []string
+	if written, ok := existing[writtenAnnotationsAnnotation]; !ok || json.Unmarshal([]byte(written), &keys) != nil {
+		return false
+	}
+	recorded := sets.NewString(keys...)
+	if recorded.Len() != len(desired) {
+		return false
+	}
+	for key := range desired {
+		if !recorded.Has(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// writtenAnnotations returns the annotation keys recorded by the last patch,
+// all the existing managed keys are returned if none are recorded.
+func (v *HPAController) writtenAnnotations(existing map[string]string) []string {
+	var keys []string
+	if written, ok := existing[writtenAnnotationsAnnotation]; ok && json.Unmarshal([]byte(written), &keys) == nil {
+		return keys
+	}
+
+	keys = make([]string, 0, len(existing))
+	for key := range existing {
+		if v.isManagedAnnotation(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// AnnotationOptions configures the annotations computed by ComputeAnnotations.
+type AnnotationOptions struct {
+	// Prefix is prepended to all managed annotation keys.
+	Prefix string
+	// PercentSuffix appends "%" to the utilization targets.
+	PercentSuffix bool
+	// Enricher returns extra annotations merged into the managed ones, they never override managed keys.
+	Enricher func(*v2.HorizontalPodAutoscaler) map[string]string
+	// DisabledResources are the resources whose Resource and ContainerResource metrics aren't annotated.
+	DisabledResources []v1.ResourceName
+	// KeyTemplate renders the keys of the metric target annotations, see KeyTemplateData.
+	KeyTemplate *template.Template
+	// EnabledMetricTypes are the source types of the annotated metrics, all of them are annotated when empty.
+	EnabledMetricTypes []v2.MetricSourceType
+	// StatusAnnotations annotates the replica counts and the metric values observed by the autoscaler,
+	// they change on most of its status updates.
+	StatusAnnotations bool
+}
+
+// ComputeAnnotations returns the annotations describing the spec and the status of the hpa,
+// it doesn't depend on any state and can be used without a controller.
+func ComputeAnnotations(hpa *v2.HorizontalPodAutoscaler, opts AnnotationOptions) map[string]string {
+	metrics := withoutResources(withMetricTypes(metricsFromV2(hpa.Spec.Metrics), opts.EnabledMetricTypes), opts.DisabledResources)
+	m := metricAnnotations(metrics, opts.PercentSuffix, opts.KeyTemplate)
+	m["metricCount"] = strconv.Itoa(len(hpa.Spec.Metrics))
+	replicaAnnotations(m, hpa)
+	statusAnnotations(m, hpa)
+	if opts.StatusAnnotations {
+		replicaCountAnnotations(m, hpa)
+		currentMetrics := withMetricTypes(metricStatusesFromV2(hpa.Status.CurrentMetrics), opts.EnabledMetricTypes)
+		currentMetricsAnnotations(m, withoutResources(currentMetrics, opts.DisabledResources))
+	}
+	behaviorAnnotations(m, hpa)
+	if summary := metricsSummary(metrics); summary != "" {
+		m["metricsSummary"] = summary
+	}
+	m["scaleTargetRef"] = formatScaleTargetRef(hpa.Spec.ScaleTargetRef)
+
+	// the names of the metrics and the containers end up in the keys, e.g. the External metric
+	// pubsub.googleapis.com|subscription|num_undelivered_messages doesn't fit in an annotation key,
+	// and a single invalid key fails the whole patch
+	valid := make(map[string]string, len(m))
+	for key, value := range m {
+		if errs := validation.IsQualifiedName(opts.Prefix + key); len(errs) != 0 {
+			klog.V(2).InfoS("Skip invalid annotation key", "hpa", klog.KObj(hpa), "key", opts.Prefix+key, "reason", strings.Join(errs, "; "))
+			continue
+		}
+		valid[opts.Prefix+key] = value
+	}
+	m = valid
+
+	if opts.Enricher != nil {
+		for key, value := range opts.Enricher(hpa) {
+			if _, ok := m[key]; !ok {
+				m[key] = value
+			}
+		}
+	}
+	return m
+}
+
+// annotations returns the desired annotations of the hpa, the annotations of the enricher
+// are merged into them but never override the managed ones.
+func (v *HPAController) annotations(hpa *v2.HorizontalPodAutoscaler) map[string]string {
+	return ComputeAnnotations(hpa, v.annotationOptions())
+}
+
+func (v *HPAController) annotationOptions() AnnotationOptions {
+	defaults := annotationDefaults{percentSuffix: v.percentSuffix, disabledResources: v.disabledResources}
+	if v.defaults != nil {
+		defaults = v.defaults.get()
+	}
+	return AnnotationOptions{
+		Prefix:             v.annotationPrefix,
+		PercentSuffix:      defaults.percentSuffix,
+		Enricher:           v.enricher,
+		DisabledResources:  defaults.disabledResources,
+		KeyTemplate:        v.keyTemplate,
+		EnabledMetricTypes: v.metricTypes.get(),
+		StatusAnnotations:  v.statusAnnotations,
+	}
+}
+
+// enabledMetricTypes holds the source types of the annotated metrics, they are changed at runtime
+// by SetEnabledMetricTypes while the workers read them.
+type enabledMetricTypes struct {
+	lock  sync.RWMutex
+	types []v2.MetricSourceType
+}
+
+func (e *enabledMetricTypes) get() []v2.MetricSourceType {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.types
+}
+
+func (e *enabledMetricTypes) set(types []v2.MetricSourceType) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.types = types
+}
+
+// SetEnabledMetricTypes restricts the annotated metrics to the given source types and resyncs all the hpas,
+// so the annotations of the disabled types are pruned without a restart. All the types are annotated
+// again when called without any.
+func (v *HPAController) SetEnabledMetricTypes(types ...v2.MetricSourceType) error {
+	for _, t := range types {
+		switch t {
+		case v2.ResourceMetricSourceType, v2.ContainerResourceMetricSourceType, v2.PodsMetricSourceType,
+			v2.ObjectMetricSourceType, v2.ExternalMetricSourceType:
+		default:
+			return fmt.Errorf("unknown metric source type %q", t)
+		}
+	}
+
+	v.metricTypes.set(append([]v2.MetricSourceType(nil), types...))
+	klog.V(2).InfoS("Updated the enabled metric types", "types", types)
+	return v.ResyncAll()
+}
+
+// withMetricTypes keeps the metrics of the enabled source types, all of them when none is enabled.
+func withMetricTypes(metrics []metric, enabled []v2.MetricSourceType) []metric {
+	if len(enabled) == 0 {
+		return metrics
+	}
+
+	kept := make([]metric, 0, len(metrics))
+	for _, metric := range metrics {
+		for _, t := range enabled {
+			if metric.source == metricSourceType(t) {
+				kept = append(kept, metric)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// withoutResources drops the Resource and ContainerResource metrics of the disabled resources.
+func withoutResources(metrics []metric, disabled []v1.ResourceName) []metric {
+	if len(disabled) == 0 {
+		return metrics
+	}
+
+	kept := make([]metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if metric.source == resourceSourceType || metric.source == containerResourceSourceType {
+			if resourceDisabled(metric.resource, disabled) {
+				continue
+			}
+		}
+		kept = append(kept, metric)
+	}
+	return kept
+}
+
+func resourceDisabled(name v1.ResourceName, disabled []v1.ResourceName) bool {
+	for _, resource := range disabled {
+		if resource == name {
+			return true
+		}
+	}
+	return false
+}
+
+// metricAnnotations returns the annotations describing the metric targets.
+func metricAnnotations(metrics []metric, percentSuffix bool, keyTemplate *template.Template) map[string]string {
+	m := make(map[string]string, 0)
+	targets := newResourceTargets()
+	targets.percentSuffix = percentSuffix
+
+	set := func(metric metric, key, field, value string) {
+		m[renderKey(keyTemplate, KeyTemplateData{
+			Key:    key + "." + metric.name,
+			Source: string(metric.source),
+			Metric: metric.name,
+			Field:  field,
+		})] = value
+	}
+
+	for _, metric := range metrics {
+		switch metric.source {
+		case resourceSourceType:
+			targets.add(metric.resource, metric.value, "")
+
+		case containerResourceSourceType:
+			targets.add(metric.resource, metric.value, "."+metric.container)
+
+		case podsSourceType:
+			if metric.value.averageValue != nil {
+				set(metric, "podsMetric", "Target", metric.value.averageValue.String())
+				if metric.selector != nil {
+					set(metric, "podsMetricSelector", "Selector", metav1.FormatLabelSelector(metric.selector))
+				}
+			}
+
+		case objectSourceType:
+			if value, ok := targetValue(metric.value); ok {
+				set(metric, "objectMetric", "Target", value)
+				set(metric, "objectMetricTarget", "DescribedObject", fmt.Sprintf("%s/%s", metric.describedObject.kind, metric.describedObject.name))
+				if metric.selector != nil {
+					set(metric, "objectMetricSelector", "Selector", metav1.FormatLabelSelector(metric.selector))
+				}
+			}
+
+		case externalSourceType:
+			if value, ok := targetValue(metric.value); ok {
+				set(metric, "externalMetric", "Target", value)
+				if metric.selector != nil {
+					set(metric, "externalMetricSelector", "Selector", metav1.FormatLabelSelector(metric.selector))
+				}
+			}
+		}
+	}
+	targets.annotations(m, keyTemplate)
+
+	return m
+}
+
+// cpuTargetOutOfRange returns the first cpu utilization target of the hpa outside the recommended range.
+func (v *HPAController) cpuTargetOutOfRange(hpa *v2.HorizontalPodAutoscaler) (int32, bool) {
+	for _, metric := range metricsFromV2(hpa.Spec.Metrics) {
+		if metric.source != resourceSourceType || metric.resource != v1.ResourceCPU {
+			continue
+		}
+		target := metric.value
+		if target.valueType != utilizationValueType || target.averageUtilization == nil {
+			continue
+		}
+		if utilization := *target.averageUtilization; utilization < v.minCPUTarget || utilization > v.maxCPUTarget {
+			return utilization, true
+		}
+	}
+	return 0, false
+}
+
+// metricsSummary summarizes the targets of the Resource metrics, the ContainerResource ones are left out.
+func metricsSummary(metrics []metric) string {
+	targets := newResourceTargets()
+	for _, metric := range metrics {
+		if metric.source == resourceSourceType {
+			targets.add(metric.resource, metric.value, "")
+		}
+	}
+	return targets.summary()
+}
+
+// replicaAnnotations fills in the replica bounds from the spec, and flags the hpas currently scaled
+// to one of the bounds once the autoscaler has reconciled them.
+func replicaAnnotations(m map[string]string, hpa *v2.HorizontalPodAutoscaler) {
+	minReplicas := int32(1)
+	if hpa.Spec.MinReplicas != nil {
+		minReplicas = *hpa.Spec.MinReplicas
+	}
+
+	m["minReplicas"] = strconv.Itoa(int(minReplicas))
+	m["maxReplicas"] = strconv.Itoa(int(hpa.Spec.MaxReplicas))
+	m["replicaRange"] = fmt.Sprintf("%d-%d", minReplicas, hpa.Spec.MaxReplicas)
+
+	// the replica counts of the hpas the autoscaler hasn't observed yet are all 0
+	if hpa.Status.ObservedGeneration == nil {
+		return
+	}
+	if hpa.Status.CurrentReplicas >= hpa.Spec.MaxReplicas {
+		m["atMaxReplicas"] = "true"
+	}
+	if hpa.Status.CurrentReplicas <= minReplicas {
+		m["atMinReplicas"] = "true"
+	}
+}
+
+// replicaCountAnnotations fills in the replica counts from the status.
+func replicaCountAnnotations(m map[string]string, hpa *v2.HorizontalPodAutoscaler) {
+	m["currentReplicas"] = strconv.Itoa(int(hpa.Status.CurrentReplicas))
+	m["desiredReplicas"] = strconv.Itoa(int(hpa.Status.DesiredReplicas))
+}
+
+// resourceTargets collects the cpu and memory targets of an hpa.
+//
+// An hpa may list several metrics for the same resource (and container), the
+// lowest target is annotated in that case since it's the one driving the
+// scaling: the autoscaler takes the highest replica count proposed by all metrics.
+// This keeps the annotations stable regardless of the order of the metrics.
+type resourceTargets struct {
+	utilizations map[string]int32
+	values       map[string]resource.Quantity
+	// keys describes the collected targets to the key template.
+	keys map[string]KeyTemplateData
+
+	// percentSuffix renders the utilizations as e.g. 80% instead of 80.
+	percentSuffix bool
+}
+
+func newResourceTargets() *resourceTargets {
+	return &resourceTargets{
+		utilizations: make(map[string]int32),
+		values:       make(map[string]resource.Quantity),
+		keys:         make(map[string]KeyTemplateData),
+	}
+}
+
+// add records a cpu or memory target, suffix is appended to the keys,
+// e.g. to distinguish the targets of different containers.
+func (r *resourceTargets) add(name v1.ResourceName, target metricValue, suffix string) {
+	var prefix string
+	switch name {
+	case v1.ResourceCPU:
+		prefix = "cpu"
+	case v1.ResourceMemory:
+		prefix = "memory"
+	default:
+		return
+	}
+
+	data := KeyTemplateData{
+		Source:    string(resourceSourceType),
+		Resource:  string(name),
+		Container: strings.TrimPrefix(suffix, "."),
+	}
+	if data.Container != "" {
+		data.Source = string(containerResourceSourceType)
+	}
+
+	switch {
+	case target.valueType == utilizationValueType && target.averageUtilization != nil:
+		key := prefix + "TargetUtilization" + suffix
+		if current, ok := r.utilizations[key]; !ok || *target.averageUtilization < current {
+			r.utilizations[key] = *target.averageUtilization
+		}
+		data.Key, data.Field = key, "TargetUtilization"
+		r.keys[key] = data
+	case target.valueType == averageValueValueType && target.averageValue != nil:
+		key := prefix + "TargetValue" + suffix
+		if current, ok := r.values[key]; !ok || target.averageValue.Cmp(current) < 0 {
+			r.values[key] = *target.averageValue
+		}
+		data.Key, data.Field = key, "TargetValue"
+		r.keys[key] = data
+	}
+}
+
+// annotations fills in the annotations of the collected targets, with the keys rendered by keyTemplate if set.
+func (r *resourceTargets) annotations(m map[string]string, keyTemplate *template.Template) {
+	for key, utilization := range r.utilizations {
+		value := fmt.Sprintf("%d", utilization)
+		if r.percentSuffix {
+			value += "%"
+		}
+		m[renderKey(keyTemplate, r.keys[key])] = value
+	}
+	for key, value := range r.values {
+		m[renderKey(keyTemplate, r.keys[key])] = value.String()
+	}
+}
+
+// summary formats the targets in a sorted list, e.g. cpu=80%,mem=512Mi.
+func (r *resourceTargets) summary() string {
+	var parts []string
+	for key, utilization := range r.utilizations {
+		if name, ok := summaryName(key, "TargetUtilization"); ok {
+			parts = append(parts, fmt.Sprintf("%s=%d%%", name, utilization))
+		}
+	}
+	for key, value := range r.values {
+		if name, ok := summaryName(key, "TargetValue"); ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", name, value.String()))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func summaryName(key, suffix string) (string, bool) {
+	if !strings.HasSuffix(key, suffix) {
+		return "", false
+	}
+	switch strings.TrimSuffix(key, suffix) {
+	case "cpu":
+		return "cpu", true
+	case "memory":
+		return "mem", true
+	}
+	return "", false
+}
+
+// formatScaleTargetRef formats the reference as <apiVersion>/<kind>/<name>, e.g. apps/v1/Deployment/nginx,
+// the apiVersion is omitted when empty.
+func formatScaleTargetRef(ref v2.CrossVersionObjectReference) string {
+	if ref.APIVersion == "" {
+		return fmt.Sprintf("%s/%s", ref.Kind, ref.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s", ref.APIVersion, ref.Kind, ref.Name)
+}
+
+// statusAnnotations fills in the annotations describing the scaling state of the hpa.
+func statusAnnotations(m map[string]string, hpa *v2.HorizontalPodAutoscaler) {
+	if hpa.Status.LastScaleTime != nil {
+		m["lastScaleTime"] = hpa.Status.LastScaleTime.UTC().Format(time.RFC3339)
+	}
+
+	// the autoscaler hasn't caught up with the latest spec, nothing is known before it first observed the hpa
+	if observed := hpa.Status.ObservedGeneration; observed != nil && *observed != hpa.Generation {
+		m["generationLag"] = "true"
+	}
+
+	for _, condition := range hpa.Status.Conditions {
+		switch condition.Type {
+		case v2.ScalingActive:
+			m["scalingActive"] = string(condition.Status)
+		case v2.AbleToScale:
+			m["ableToScale"] = string(condition.Status)
+		}
+	}
+}
+
+// currentMetricsAnnotations fills in the metric values last observed by the autoscaler.
+func currentMetricsAnnotations(m map[string]string, metrics []metric) {
+	for _, metric := range metrics {
+		switch metric.source {
+		case resourceSourceType:
+			currentResourceAnnotations(m, metric.resource, metric.value, "")
+		case containerResourceSourceType:
+			currentResourceAnnotations(m, metric.resource, metric.value, "."+metric.container)
+		case podsSourceType:
+			if value, ok := currentValue(metric.value); ok {
+				m["currentPodsMetric."+metric.name] = value
+			}
+		case objectSourceType:
+			if value, ok := currentValue(metric.value); ok {
+				m["currentObjectMetric."+metric.name] = value
+			}
+		case externalSourceType:
+			if value, ok := currentValue(metric.value); ok {
+				m["currentExternalMetric."+metric.name] = value
+			}
+		}
+	}
+}
+
+func currentResourceAnnotations(m map[string]string, name v1.ResourceName, current metricValue, suffix string) {
+	var prefix string
+	switch name {
+	case v1.ResourceCPU:
+		prefix = "currentCpu"
+	case v1.ResourceMemory:
+		prefix = "currentMemory"
+	default:
+		return
+	}
+
+	if current.averageUtilization != nil {
+		m[prefix+"Utilization"+suffix] = strconv.Itoa(int(*current.averageUtilization))
+	}
+	if current.averageValue != nil {
+		m[prefix+"Value"+suffix] = current.averageValue.String()
+	}
+}
+
+// currentValue returns the Value or AverageValue of the observed metric.
+func currentValue(current metricValue) (string, bool) {
+	switch {
+	case current.value != nil:
+		return current.value.String(), true
+	case current.averageValue != nil:
+		return current.averageValue.String(), true
+	}
+	return "", false
+}
+
+// behaviorAnnotations fills in the stabilization windows of the scaling behavior, if configured.
+func behaviorAnnotations(m map[string]string, hpa *v2.HorizontalPodAutoscaler) {
+	behavior := hpa.Spec.Behavior
+	if behavior == nil {
+		return
+	}
+
+	if behavior.ScaleUp != nil && behavior.ScaleUp.StabilizationWindowSeconds != nil {
+		m["scaleUpStabilizationWindowSeconds"] = strconv.Itoa(int(*behavior.ScaleUp.StabilizationWindowSeconds))
+	}
+	if behavior.ScaleDown != nil && behavior.ScaleDown.StabilizationWindowSeconds != nil {
+		m["scaleDownStabilizationWindowSeconds"] = strconv.Itoa(int(*behavior.ScaleDown.StabilizationWindowSeconds))
+	}
+	if policies := policiesSummary(behavior.ScaleUp); policies != "" {
+		m["scaleUpPolicies"] = policies
+	}
+	if policies := policiesSummary(behavior.ScaleDown); policies != "" {
+		m["scaleDownPolicies"] = policies
+	}
+	if behavior.ScaleUp != nil && behavior.ScaleUp.SelectPolicy != nil {
+		m["scaleUpSelectPolicy"] = string(*behavior.ScaleUp.SelectPolicy)
+	}
+	if behavior.ScaleDown != nil && behavior.ScaleDown.SelectPolicy != nil {
+		m["scaleDownSelectPolicy"] = string(*behavior.ScaleDown.SelectPolicy)
+	}
+}
+
+// policiesSummary returns the policies of the rules in the form "Percent=100/15s,Pods=4/15s",
+// keeping the order of the spec.
+func policiesSummary(rules *v2.HPAScalingRules) string {
+	if rules == nil {
+		return ""
+	}
+
+	policies := make([]string, 0, len(rules.Policies))
+	for _, policy := range rules.Policies {
+		policies = append(policies, fmt.Sprintf("%s=%d/%ds", policy.Type, policy.Value, policy.PeriodSeconds))
+	}
+	return strings.Join(policies, ",")
+}
+
+// targetValue returns the Value or AverageValue of the target depending on its type.
+func targetValue(target metricValue) (string, bool) {
+	switch {
+	case target.valueType == valueValueType && target.value != nil:
+		return target.value.String(), true
+	case target.valueType == averageValueValueType && target.averageValue != nil:
+		return target.averageValue.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,1123 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func resourceUtilizationMetric(name v1.ResourceName, utilization int32) v2.MetricSpec {
+	return v2.MetricSpec{
+		Type: v2.ResourceMetricSourceType,
+		Resource: &v2.ResourceMetricSource{
+			Name: name,
+			Target: v2.MetricTarget{
+				Type:               v2.UtilizationMetricType,
+				AverageUtilization: &utilization,
+			},
+		},
+	}
+}
+
+func resourceAverageValueMetric(name v1.ResourceName, value string) v2.MetricSpec {
+	quantity := resource.MustParse(value)
+	return v2.MetricSpec{
+		Type: v2.ResourceMetricSourceType,
+		Resource: &v2.ResourceMetricSource{
+			Name: name,
+			Target: v2.MetricTarget{
+				Type:         v2.AverageValueMetricType,
+				AverageValue: &quantity,
+			},
+		},
+	}
+}
+
+// targetAnnotations returns the annotations computed for the hpa without the ones every hpa gets,
+// leaving the metric target annotations.
+func targetAnnotations(opts AnnotationOptions, hpa *v2.HorizontalPodAutoscaler) map[string]string {
+	m := ComputeAnnotations(hpa, opts)
+	for _, key := range []string{"metricCount", "minReplicas", "maxReplicas", "replicaRange", "metricsSummary", "scaleTargetRef"} {
+		delete(m, opts.Prefix+key)
+	}
+	return m
+}
+
+func TestAnnotationsCPUUtilization(t *testing.T) {
+	m := targetAnnotations(AnnotationOptions{}, newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80)))
+
+	if got := m["cpuTargetUtilization"]; got != "80" {
+		t.Errorf("expected cpuTargetUtilization 80, got %q", got)
+	}
+}
+
+func TestAnnotationsPercentSuffix(t *testing.T) {
+	tests := []struct {
+		name          string
+		percentSuffix bool
+		expected      string
+	}{
+		{name: "plain integer by default", expected: "80"},
+		{name: "percent suffix", percentSuffix: true, expected: "80%"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := targetAnnotations(AnnotationOptions{PercentSuffix: test.percentSuffix}, newHPA("test",
+				resourceUtilizationMetric(v1.ResourceCPU, 80),
+				resourceAverageValueMetric(v1.ResourceMemory, "512Mi")))
+
+			if got := m["cpuTargetUtilization"]; got != test.expected {
+				t.Errorf("expected cpuTargetUtilization %s, got %q", test.expected, got)
+			}
+			if got := m["memoryTargetValue"]; got != "512Mi" {
+				t.Errorf("expected memoryTargetValue 512Mi, got %q", got)
+			}
+		})
+	}
+}
+
+func TestAnnotationsCPUAverageValue(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("annotations panicked on AverageValue cpu target: %v", r)
+		}
+	}()
+
+	m := targetAnnotations(AnnotationOptions{}, newHPA("test", resourceAverageValueMetric(v1.ResourceCPU, "500m")))
+
+	if _, ok := m["cpuTargetUtilization"]; ok {
+		t.Errorf("unexpected cpuTargetUtilization annotation for AverageValue target: %v", m)
+	}
+	if got := m["cpuTargetValue"]; got != "500m" {
+		t.Errorf("expected cpuTargetValue 500m, got %q", got)
+	}
+}
+
+func TestAnnotationsMemory(t *testing.T) {
+	tests := []struct {
+		name     string
+		metric   v2.MetricSpec
+		expected map[string]string
+	}{
+		{
+			name:     "utilization",
+			metric:   resourceUtilizationMetric(v1.ResourceMemory, 60),
+			expected: map[string]string{"memoryTargetUtilization": "60"},
+		},
+		{
+			name:     "average value in Mi",
+			metric:   resourceAverageValueMetric(v1.ResourceMemory, "512Mi"),
+			expected: map[string]string{"memoryTargetValue": "512Mi"},
+		},
+		{
+			name:     "average value in Gi",
+			metric:   resourceAverageValueMetric(v1.ResourceMemory, "2Gi"),
+			expected: map[string]string{"memoryTargetValue": "2Gi"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := targetAnnotations(AnnotationOptions{}, newHPA("test", test.metric))
+			if !reflect.DeepEqual(m, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, m)
+			}
+		})
+	}
+}
+
+func TestAnnotationsMemoryQuantityFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		quantity *resource.Quantity
+		expected string
+	}{
+		{
+			name:     "binary bytes as Mi",
+			quantity: resource.NewQuantity(536870912, resource.BinarySI),
+			expected: "512Mi",
+		},
+		{
+			name:     "binary bytes as Gi",
+			quantity: resource.NewQuantity(1073741824, resource.BinarySI),
+			expected: "1Gi",
+		},
+		{
+			name:     "decimal bytes",
+			quantity: resource.NewQuantity(500000000, resource.DecimalSI),
+			expected: "500M",
+		},
+		{
+			name:     "milli value",
+			quantity: resource.NewMilliQuantity(500, resource.DecimalSI),
+			expected: "500m",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metric := resourceAverageValueMetric(v1.ResourceMemory, "0")
+			metric.Resource.Target.AverageValue = test.quantity
+
+			got := targetAnnotations(AnnotationOptions{}, newHPA("test", metric))["memoryTargetValue"]
+			if got != test.expected {
+				t.Fatalf("expected memoryTargetValue %s, got %s", test.expected, got)
+			}
+			if parsed := resource.MustParse(got); parsed.Cmp(*test.quantity) != 0 {
+				t.Errorf("expected %s to round-trip to %s, got %s", got, test.quantity.String(), parsed.String())
+			}
+		})
+	}
+}
+
+func containerUtilizationMetric(name v1.ResourceName, container string, utilization int32) v2.MetricSpec {
+	return v2.MetricSpec{
+		Type: v2.ContainerResourceMetricSourceType,
+		ContainerResource: &v2.ContainerResourceMetricSource{
+			Name:      name,
+			Container: container,
+			Target: v2.MetricTarget{
+				Type:               v2.UtilizationMetricType,
+				AverageUtilization: &utilization,
+			},
+		},
+	}
+}
+
+func TestAnnotationsContainerResource(t *testing.T) {
+	memory := resource.MustParse("256Mi")
+	sidecarMemory := v2.MetricSpec{
+		Type: v2.ContainerResourceMetricSourceType,
+		ContainerResource: &v2.ContainerResourceMetricSource{
+			Name:      v1.ResourceMemory,
+			Container: "sidecar",
+			Target: v2.MetricTarget{
+				Type:         v2.AverageValueMetricType,
+				AverageValue: &memory,
+			},
+		},
+	}
+
+	m := targetAnnotations(AnnotationOptions{}, newHPA("test",
+		containerUtilizationMetric(v1.ResourceCPU, "app", 70),
+		containerUtilizationMetric(v1.ResourceCPU, "sidecar", 50),
+		sidecarMemory,
+	))
+
+	expected := map[string]string{
+		"cpuTargetUtilization.app":     "70",
+		"cpuTargetUtilization.sidecar": "50",
+		"memoryTargetValue.sidecar":    "256Mi",
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, got %v", expected, m)
+	}
+}
+
+func TestAnnotationsPods(t *testing.T) {
+	value := resource.MustParse("1k")
+	pods := v2.MetricSpec{
+		Type: v2.PodsMetricSourceType,
+		Pods: &v2.PodsMetricSource{
+			Metric: v2.MetricIdentifier{Name: "packets-per-second"},
+			Target: v2.MetricTarget{
+				Type:         v2.AverageValueMetricType,
+				AverageValue: &value,
+			},
+		},
+	}
+	noValue := v2.MetricSpec{
+		Type: v2.PodsMetricSourceType,
+		Pods: &v2.PodsMetricSource{
+			Metric: v2.MetricIdentifier{Name: "no-value"},
+			Target: v2.MetricTarget{Type: v2.AverageValueMetricType},
+		},
+	}
+
+	m := targetAnnotations(AnnotationOptions{}, newHPA("test", pods, noValue))
+
+	expected := map[string]string{"podsMetric.packets-per-second": "1k"}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, got %v", expected, m)
+	}
+}
+
+func TestAnnotationsPodsSelector(t *testing.T) {
+	averageValue := resource.MustParse("1k")
+	pods := func(name string, selector *metav1.LabelSelector) v2.MetricSpec {
+		return v2.MetricSpec{
+			Type: v2.PodsMetricSourceType,
+			Pods: &v2.PodsMetricSource{
+				Metric: v2.MetricIdentifier{Name: name, Selector: selector},
+				Target: v2.MetricTarget{Type: v2.AverageValueMetricType, AverageValue: &averageValue},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		selector *metav1.LabelSelector
+		expected map[string]string
+	}{
+		{
+			name: "without selector",
+			expected: map[string]string{
+				"podsMetric.packets-per-second": "1k",
+			},
+		},
+		{
+			name: "with selector",
+			selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"verb": "GET"},
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "path", Operator: metav1.LabelSelectorOpIn, Values: []string{"api"}},
+				},
+			},
+			expected: map[string]string{
+				"podsMetric.packets-per-second":         "1k",
+				"podsMetricSelector.packets-per-second": "path in (api),verb=GET",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := targetAnnotations(AnnotationOptions{}, newHPA("test", pods("packets-per-second", test.selector)))
+			if !reflect.DeepEqual(m, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, m)
+			}
+		})
+	}
+}
+
+func TestAnnotationsObject(t *testing.T) {
+	value := resource.MustParse("10k")
+	averageValue := resource.MustParse("100")
+	object := func(name string, target v2.MetricTarget) v2.MetricSpec {
+		return v2.MetricSpec{
+			Type: v2.ObjectMetricSourceType,
+			Object: &v2.ObjectMetricSource{
+				DescribedObject: v2.CrossVersionObjectReference{
+					APIVersion: "networking.k8s.io/v1",
+					Kind:       "Ingress",
+					Name:       "main-route",
+				},
+				Metric: v2.MetricIdentifier{Name: name},
+				Target: target,
+			},
+		}
+	}
+
+	m := targetAnnotations(AnnotationOptions{}, newHPA("test",
+		object("requests-per-second", v2.MetricTarget{Type: v2.ValueMetricType, Value: &value}),
+		object("requests-per-pod", v2.MetricTarget{Type: v2.AverageValueMetricType, AverageValue: &averageValue}),
+	))
+
+	expected := map[string]string{
+		"objectMetric.requests-per-second":       "10k",
+		"objectMetricTarget.requests-per-second": "Ingress/main-route",
+		"objectMetric.requests-per-pod":          "100",
+		"objectMetricTarget.requests-per-pod":    "Ingress/main-route",
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, got %v", expected, m)
+	}
+}
+
+func TestAnnotationsExternal(t *testing.T) {
+	value := resource.MustParse("30")
+	external := v2.MetricSpec{
+		Type: v2.ExternalMetricSourceType,
+		External: &v2.ExternalMetricSource{
+			Metric: v2.MetricIdentifier{
+				Name: "queue-messages",
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"queue": "worker-tasks"},
+				},
+			},
+			Target: v2.MetricTarget{
+				Type:         v2.AverageValueMetricType,
+				AverageValue: &value,
+			},
+		},
+	}
+
+	m := targetAnnotations(AnnotationOptions{}, newHPA("test", external))
+
+	expected := map[string]string{
+		"externalMetric.queue-messages":         "30",
+		"externalMetricSelector.queue-messages": "queue=worker-tasks",
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, got %v", expected, m)
+	}
+}
+
+func TestAnnotationsSkipInvalidKeys(t *testing.T) {
+	value := resource.MustParse("30")
+	external := func(name string) v2.MetricSpec {
+		return v2.MetricSpec{
+			Type: v2.ExternalMetricSourceType,
+			External: &v2.ExternalMetricSource{
+				Metric: v2.MetricIdentifier{Name: name},
+				Target: v2.MetricTarget{Type: v2.AverageValueMetricType, AverageValue: &value},
+			},
+		}
+	}
+	hpa := newHPA("test",
+		external("pubsub.googleapis.com|subscription|num_undelivered_messages"),
+		external("queue-messages"))
+
+	for _, opts := range []AnnotationOptions{{}, {Prefix: "autoscaling.kubesphere.io/"}} {
+		m := targetAnnotations(opts, hpa)
+		expected := map[string]string{opts.Prefix + "externalMetric.queue-messages": "30"}
+		if !reflect.DeepEqual(m, expected) {
+			t.Errorf("expected %v, got %v", expected, m)
+		}
+	}
+}
+
+func TestAnnotationsMultipleCPUMetrics(t *testing.T) {
+	metrics := []v2.MetricSpec{
+		resourceUtilizationMetric(v1.ResourceCPU, 80),
+		resourceUtilizationMetric(v1.ResourceCPU, 60),
+		resourceAverageValueMetric(v1.ResourceCPU, "500m"),
+		resourceAverageValueMetric(v1.ResourceCPU, "1"),
+	}
+	reversed := []v2.MetricSpec{metrics[3], metrics[2], metrics[1], metrics[0]}
+
+	expected := map[string]string{
+		"cpuTargetUtilization": "60",
+		"cpuTargetValue":       "500m",
+	}
+
+	for _, metrics := range [][]v2.MetricSpec{metrics, reversed} {
+		if m := targetAnnotations(AnnotationOptions{}, newHPA("test", metrics...)); !reflect.DeepEqual(m, expected) {
+			t.Errorf("expected %v, got %v", expected, m)
+		}
+	}
+}
+
+func TestIsManagedAnnotation(t *testing.T) {
+	tests := map[string]bool{
+		"cpuTargetUtilization":     true,
+		"cpuTargetUtilization.app": true,
+		"cpuTargetUtilizationX":    false,
+		"user":                     false,
+	}
+
+	v := &HPAController{}
+	for key, expected := range tests {
+		if got := v.isManagedAnnotation(key); got != expected {
+			t.Errorf("isManagedAnnotation(%q) = %v, expected %v", key, got, expected)
+		}
+	}
+}
+
+func TestAnnotationsPrefix(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+
+	v := &HPAController{}
+	if m := v.annotations(hpa); m["cpuTargetUtilization"] != "80" {
+		t.Errorf("unexpected default annotations %v", m)
+	}
+
+	prefix := "autoscaling.kubesphere.io/"
+	v = &HPAController{annotationPrefix: prefix}
+	m := v.annotations(hpa)
+	if m[prefix+"cpuTargetUtilization"] != "80" {
+		t.Errorf("unexpected prefixed annotations %v", m)
+	}
+	for key := range m {
+		if !strings.HasPrefix(key, prefix) {
+			t.Errorf("expected all keys to be prefixed, got %q", key)
+		}
+	}
+
+	if v.isManagedAnnotation("cpuTargetUtilization") {
+		t.Errorf("unprefixed key should not be managed when a prefix is configured")
+	}
+	if !v.isManagedAnnotation("autoscaling.kubesphere.io/cpuTargetUtilization") {
+		t.Errorf("prefixed key should be managed")
+	}
+}
+
+func TestReplicaAnnotations(t *testing.T) {
+	minReplicas := int32(2)
+
+	tests := []struct {
+		name        string
+		minReplicas *int32
+		expected    map[string]string
+	}{
+		{
+			name:        "explicit min replicas",
+			minReplicas: &minReplicas,
+			expected: map[string]string{
+				"minReplicas":  "2",
+				"maxReplicas":  "10",
+				"replicaRange": "2-10",
+			},
+		},
+		{
+			name: "default min replicas",
+			expected: map[string]string{
+				"minReplicas":  "1",
+				"maxReplicas":  "10",
+				"replicaRange": "1-10",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test")
+			hpa.Spec.MinReplicas = test.minReplicas
+			hpa.Status.CurrentReplicas = 3
+			hpa.Status.DesiredReplicas = 5
+
+			m := make(map[string]string)
+			replicaAnnotations(m, hpa)
+			if !reflect.DeepEqual(m, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, m)
+			}
+		})
+	}
+}
+
+func TestReplicaBoundAnnotations(t *testing.T) {
+	minReplicas := int32(2)
+
+	tests := []struct {
+		name            string
+		minReplicas     *int32
+		currentReplicas int32
+		unobserved      bool
+		atMax           bool
+		atMin           bool
+	}{
+		{name: "at max replicas", minReplicas: &minReplicas, currentReplicas: 10, atMax: true},
+		{name: "above max replicas", minReplicas: &minReplicas, currentReplicas: 11, atMax: true},
+		{name: "below max replicas", minReplicas: &minReplicas, currentReplicas: 9},
+		{name: "at min replicas", minReplicas: &minReplicas, currentReplicas: 2, atMin: true},
+		{name: "above min replicas", minReplicas: &minReplicas, currentReplicas: 3},
+		{name: "at default min replicas", currentReplicas: 1, atMin: true},
+		{name: "above default min replicas", currentReplicas: 2},
+		{name: "not observed by the autoscaler", currentReplicas: 0, unobserved: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test")
+			hpa.Spec.MinReplicas = test.minReplicas
+			hpa.Status.CurrentReplicas = test.currentReplicas
+			if !test.unobserved {
+				generation := int64(1)
+				hpa.Status.ObservedGeneration = &generation
+			}
+
+			m := make(map[string]string)
+			replicaAnnotations(m, hpa)
+			if _, ok := m["atMaxReplicas"]; ok != test.atMax {
+				t.Errorf("expected atMaxReplicas %v, got %v", test.atMax, m)
+			}
+			if _, ok := m["atMinReplicas"]; ok != test.atMin {
+				t.Errorf("expected atMinReplicas %v, got %v", test.atMin, m)
+			}
+			if ok := m["atMaxReplicas"] == "true" || m["atMinReplicas"] == "true"; ok != (test.atMax || test.atMin) {
+				t.Errorf("expected the bound annotations to be \"true\", got %v", m)
+			}
+		})
+	}
+}
+
+func TestReplicaRangeAnnotation(t *testing.T) {
+	minReplicas := int32(3)
+
+	tests := []struct {
+		name        string
+		minReplicas *int32
+		expected    string
+	}{
+		{name: "explicit min replicas", minReplicas: &minReplicas, expected: "3-10"},
+		{name: "default min replicas", expected: "1-10"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test")
+			hpa.Spec.MinReplicas = test.minReplicas
+
+			m := make(map[string]string)
+			replicaAnnotations(m, hpa)
+			if got := m["replicaRange"]; got != test.expected {
+				t.Errorf("expected replicaRange %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestStatusAnnotationsLastScaleTime(t *testing.T) {
+	hpa := newHPA("test")
+
+	m := make(map[string]string)
+	statusAnnotations(m, hpa)
+	if _, ok := m["lastScaleTime"]; ok {
+		t.Errorf("expected no lastScaleTime when unset, got %v", m)
+	}
+
+	lastScaleTime := metav1.NewTime(time.Date(2023, 3, 1, 8, 30, 0, 0, time.UTC))
+	hpa.Status.LastScaleTime = &lastScaleTime
+	statusAnnotations(m, hpa)
+	if got := m["lastScaleTime"]; got != "2023-03-01T08:30:00Z" {
+		t.Errorf("expected lastScaleTime 2023-03-01T08:30:00Z, got %q", got)
+	}
+}
+
+func TestFormatScaleTargetRef(t *testing.T) {
+	tests := []struct {
+		ref      v2.CrossVersionObjectReference
+		expected string
+	}{
+		{
+			ref:      v2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "nginx"},
+			expected: "apps/v1/Deployment/nginx",
+		},
+		{
+			ref:      v2.CrossVersionObjectReference{Kind: "Deployment", Name: "nginx"},
+			expected: "Deployment/nginx",
+		},
+	}
+
+	for _, test := range tests {
+		if got := formatScaleTargetRef(test.ref); got != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, got)
+		}
+	}
+
+	v := &HPAController{}
+	if got := v.annotations(newHPA("nginx"))["scaleTargetRef"]; got != "apps/v1/Deployment/nginx" {
+		t.Errorf("expected scaleTargetRef apps/v1/Deployment/nginx, got %q", got)
+	}
+}
+
+func TestStatusAnnotationsConditions(t *testing.T) {
+	hpa := newHPA("test")
+	hpa.Status.Conditions = []v2.HorizontalPodAutoscalerCondition{
+		{Type: v2.ScalingActive, Status: v1.ConditionFalse, Reason: "FailedGetResourceMetric"},
+	}
+
+	m := make(map[string]string)
+	statusAnnotations(m, hpa)
+
+	expected := map[string]string{"scalingActive": "False"}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, got %v", expected, m)
+	}
+}
+
+func TestBehaviorAnnotations(t *testing.T) {
+	seconds := func(n int32) *int32 { return &n }
+	selectPolicy := func(p v2.ScalingPolicySelect) *v2.ScalingPolicySelect { return &p }
+
+	tests := []struct {
+		name     string
+		behavior *v2.HorizontalPodAutoscalerBehavior
+		expected map[string]string
+	}{
+		{
+			name:     "no behavior",
+			expected: map[string]string{},
+		},
+		{
+			name: "scale up and down",
+			behavior: &v2.HorizontalPodAutoscalerBehavior{
+				ScaleUp:   &v2.HPAScalingRules{StabilizationWindowSeconds: seconds(0)},
+				ScaleDown: &v2.HPAScalingRules{StabilizationWindowSeconds: seconds(300)},
+			},
+			expected: map[string]string{
+				"scaleUpStabilizationWindowSeconds":   "0",
+				"scaleDownStabilizationWindowSeconds": "300",
+			},
+		},
+		{
+			name: "scale down without window",
+			behavior: &v2.HorizontalPodAutoscalerBehavior{
+				ScaleDown: &v2.HPAScalingRules{},
+			},
+			expected: map[string]string{},
+		},
+		{
+			name: "mixed policies",
+			behavior: &v2.HorizontalPodAutoscalerBehavior{
+				ScaleUp: &v2.HPAScalingRules{
+					Policies: []v2.HPAScalingPolicy{
+						{Type: v2.PercentScalingPolicy, Value: 100, PeriodSeconds: 15},
+						{Type: v2.PodsScalingPolicy, Value: 4, PeriodSeconds: 15},
+					},
+				},
+				ScaleDown: &v2.HPAScalingRules{
+					StabilizationWindowSeconds: seconds(300),
+					Policies: []v2.HPAScalingPolicy{
+						{Type: v2.PodsScalingPolicy, Value: 1, PeriodSeconds: 60},
+					},
+				},
+			},
+			expected: map[string]string{
+				"scaleUpPolicies":                     "Percent=100/15s,Pods=4/15s",
+				"scaleDownStabilizationWindowSeconds": "300",
+				"scaleDownPolicies":                   "Pods=1/60s",
+			},
+		},
+		{
+			name: "max select policy",
+			behavior: &v2.HorizontalPodAutoscalerBehavior{
+				ScaleUp: &v2.HPAScalingRules{SelectPolicy: selectPolicy(v2.MaxChangePolicySelect)},
+			},
+			expected: map[string]string{"scaleUpSelectPolicy": "Max"},
+		},
+		{
+			name: "min select policy",
+			behavior: &v2.HorizontalPodAutoscalerBehavior{
+				ScaleDown: &v2.HPAScalingRules{SelectPolicy: selectPolicy(v2.MinChangePolicySelect)},
+			},
+			expected: map[string]string{"scaleDownSelectPolicy": "Min"},
+		},
+		{
+			name: "disabled select policy",
+			behavior: &v2.HorizontalPodAutoscalerBehavior{
+				ScaleUp:   &v2.HPAScalingRules{SelectPolicy: selectPolicy(v2.MaxChangePolicySelect)},
+				ScaleDown: &v2.HPAScalingRules{SelectPolicy: selectPolicy(v2.DisabledPolicySelect)},
+			},
+			expected: map[string]string{
+				"scaleUpSelectPolicy":   "Max",
+				"scaleDownSelectPolicy": "Disabled",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test")
+			hpa.Spec.Behavior = test.behavior
+
+			m := make(map[string]string)
+			behaviorAnnotations(m, hpa)
+			if !reflect.DeepEqual(m, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, m)
+			}
+		})
+	}
+}
+
+func TestMetricsSummary(t *testing.T) {
+	tests := []struct {
+		name     string
+		metrics  []v2.MetricSpec
+		expected string
+	}{
+		{
+			name:     "no resource metrics",
+			expected: "",
+		},
+		{
+			name: "cpu and memory",
+			metrics: []v2.MetricSpec{
+				resourceAverageValueMetric(v1.ResourceMemory, "512Mi"),
+				resourceUtilizationMetric(v1.ResourceCPU, 80),
+			},
+			expected: "cpu=80%,mem=512Mi",
+		},
+		{
+			name: "container metrics are left out",
+			metrics: []v2.MetricSpec{
+				containerUtilizationMetric(v1.ResourceCPU, "app", 50),
+				resourceUtilizationMetric(v1.ResourceMemory, 70),
+			},
+			expected: "mem=70%",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := metricsSummary(metricsFromV2(test.metrics)); got != test.expected {
+				t.Errorf("expected summary %q, got %q", test.expected, got)
+			}
+
+			// the summary doesn't depend on the order of the metrics
+			reversed := make([]v2.MetricSpec, len(test.metrics))
+			for i, metric := range test.metrics {
+				reversed[len(test.metrics)-1-i] = metric
+			}
+			if got := metricsSummary(metricsFromV2(reversed)); got != test.expected {
+				t.Errorf("expected summary %q with reversed metrics, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestCurrentMetricsAnnotations(t *testing.T) {
+	utilization := int32(65)
+	memory := resource.MustParse("300Mi")
+	requests := resource.MustParse("120")
+	queueLength := resource.MustParse("30")
+
+	tests := []struct {
+		name     string
+		current  []v2.MetricStatus
+		expected map[string]string
+	}{
+		{
+			name:     "no current metrics",
+			expected: map[string]string{},
+		},
+		{
+			name: "populated status",
+			current: []v2.MetricStatus{
+				{
+					Type: v2.ResourceMetricSourceType,
+					Resource: &v2.ResourceMetricStatus{
+						Name:    v1.ResourceCPU,
+						Current: v2.MetricValueStatus{AverageUtilization: &utilization, AverageValue: resource.NewMilliQuantity(130, resource.DecimalSI)},
+					},
+				},
+				{
+					Type: v2.ResourceMetricSourceType,
+					Resource: &v2.ResourceMetricStatus{
+						Name:    v1.ResourceMemory,
+						Current: v2.MetricValueStatus{AverageValue: &memory},
+					},
+				},
+				{
+					Type: v2.PodsMetricSourceType,
+					Pods: &v2.PodsMetricStatus{
+						Metric:  v2.MetricIdentifier{Name: "requests_per_second"},
+						Current: v2.MetricValueStatus{AverageValue: &requests},
+					},
+				},
+				{
+					Type: v2.ExternalMetricSourceType,
+					External: &v2.ExternalMetricStatus{
+						Metric:  v2.MetricIdentifier{Name: "queue_length"},
+						Current: v2.MetricValueStatus{Value: &queueLength},
+					},
+				},
+			},
+			expected: map[string]string{
+				"currentCpuUtilization":                 "65",
+				"currentCpuValue":                       "130m",
+				"currentMemoryValue":                    "300Mi",
+				"currentPodsMetric.requests_per_second": "120",
+				"currentExternalMetric.queue_length":    "30",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test")
+			hpa.Status.CurrentMetrics = test.current
+
+			m := make(map[string]string)
+			currentMetricsAnnotations(m, metricStatusesFromV2(hpa.Status.CurrentMetrics))
+			if !reflect.DeepEqual(m, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, m)
+			}
+		})
+	}
+}
+
+func TestAnnotationsPatchIsOrderIndependent(t *testing.T) {
+	v := &HPAController{}
+	hpa := newHPA("test",
+		resourceUtilizationMetric(v1.ResourceCPU, 80),
+		resourceAverageValueMetric(v1.ResourceMemory, "512Mi"))
+
+	// the existing annotations record the written keys in another order than the desired ones
+	existing := v.annotations(hpa)
+	keys := make([]string, 0, len(existing))
+	for key := range existing {
+		keys = append(keys, key)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	written, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing[writtenAnnotationsAnnotation] = string(written)
+
+	// every run iterates the maps in a different order
+	for i := 0; i < 10; i++ {
+		if patch := v.annotationsPatch(existing, v.annotations(hpa)); len(patch) != 0 {
+			t.Fatalf("expected no patch for identical annotations, got %v", patch)
+		}
+	}
+}
+
+func TestComputeAnnotations(t *testing.T) {
+	utilization := int32(65)
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	hpa.Spec.MinReplicas = nil
+	hpa.Status.CurrentReplicas = 2
+	hpa.Status.DesiredReplicas = 3
+	hpa.Status.CurrentMetrics = []v2.MetricStatus{{
+		Type:     v2.ResourceMetricSourceType,
+		Resource: &v2.ResourceMetricStatus{Name: v1.ResourceCPU, Current: v2.MetricValueStatus{AverageUtilization: &utilization}},
+	}}
+
+	tests := []struct {
+		name     string
+		opts     AnnotationOptions
+		expected map[string]string
+	}{
+		{
+			name: "defaults",
+			expected: map[string]string{
+				"cpuTargetUtilization": "80",
+				"metricCount":          "1",
+				"minReplicas":          "1",
+				"maxReplicas":          "10",
+				"replicaRange":         "1-10",
+				"metricsSummary":       "cpu=80%",
+				"scaleTargetRef":       "apps/v1/Deployment/test",
+			},
+		},
+		{
+			name: "prefix and percent suffix",
+			opts: AnnotationOptions{Prefix: "hpa.kubesphere.io/", PercentSuffix: true},
+			expected: map[string]string{
+				"hpa.kubesphere.io/cpuTargetUtilization": "80%",
+				"hpa.kubesphere.io/metricCount":          "1",
+				"hpa.kubesphere.io/minReplicas":          "1",
+				"hpa.kubesphere.io/maxReplicas":          "10",
+				"hpa.kubesphere.io/replicaRange":         "1-10",
+				"hpa.kubesphere.io/metricsSummary":       "cpu=80%",
+				"hpa.kubesphere.io/scaleTargetRef":       "apps/v1/Deployment/test",
+			},
+		},
+		{
+			name: "enricher never overrides managed keys",
+			opts: AnnotationOptions{Enricher: func(hpa *v2.HorizontalPodAutoscaler) map[string]string {
+				return map[string]string{"team": "autoscaling", "maxReplicas": "100"}
+			}},
+			expected: map[string]string{
+				"cpuTargetUtilization": "80",
+				"metricCount":          "1",
+				"minReplicas":          "1",
+				"maxReplicas":          "10",
+				"replicaRange":         "1-10",
+				"metricsSummary":       "cpu=80%",
+				"scaleTargetRef":       "apps/v1/Deployment/test",
+				"team":                 "autoscaling",
+			},
+		},
+		{
+			name: "status annotations",
+			opts: AnnotationOptions{StatusAnnotations: true},
+			expected: map[string]string{
+				"cpuTargetUtilization":  "80",
+				"currentCpuUtilization": "65",
+				"metricCount":           "1",
+				"minReplicas":           "1",
+				"maxReplicas":           "10",
+				"replicaRange":          "1-10",
+				"currentReplicas":       "2",
+				"desiredReplicas":       "3",
+				"metricsSummary":        "cpu=80%",
+				"scaleTargetRef":        "apps/v1/Deployment/test",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := ComputeAnnotations(hpa, test.opts)
+			if !reflect.DeepEqual(m, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, m)
+			}
+		})
+	}
+}
+
+func TestSetEnabledMetricTypes(t *testing.T) {
+	value := resource.MustParse("1k")
+	pods := v2.MetricSpec{
+		Type: v2.PodsMetricSourceType,
+		Pods: &v2.PodsMetricSource{
+			Metric: v2.MetricIdentifier{Name: "packets-per-second"},
+			Target: v2.MetricTarget{Type: v2.AverageValueMetricType, AverageValue: &value},
+		},
+	}
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80), pods)
+	f := newFixtureWithOptions(t, nil, hpa)
+
+	// toggle sets the enabled types, drains the resynced hpa and syncs it again
+	toggle := func(types ...v2.MetricSourceType) map[string]string {
+		t.Helper()
+		f.updateLister(f.get(hpa))
+		if err := f.controller.SetEnabledMetricTypes(types...); err != nil {
+			t.Fatal(err)
+		}
+		if n := f.controller.queue.Len(); n != 1 {
+			t.Fatalf("expected the hpa to be resynced, got %d queued", n)
+		}
+		key, _ := f.controller.queue.Get()
+		f.controller.queue.Done(key)
+		f.sync(hpa)
+		return f.get(hpa).Annotations
+	}
+
+	f.sync(hpa)
+	got := f.get(hpa).Annotations
+	if got["cpuTargetUtilization"] != "80" || got["podsMetric.packets-per-second"] != "1k" {
+		t.Fatalf("expected all the metric types annotated by default, got %v", got)
+	}
+
+	got = toggle(v2.PodsMetricSourceType)
+	if _, ok := got["cpuTargetUtilization"]; ok {
+		t.Errorf("expected the Resource metrics to be disabled, got %v", got)
+	}
+	if got["podsMetric.packets-per-second"] != "1k" {
+		t.Errorf("expected the Pods metrics to be kept, got %v", got)
+	}
+
+	got = toggle()
+	if got["cpuTargetUtilization"] != "80" || got["podsMetric.packets-per-second"] != "1k" {
+		t.Errorf("expected all the metric types annotated again, got %v", got)
+	}
+
+	if err := f.controller.SetEnabledMetricTypes("Unknown"); err == nil {
+		t.Error("expected an error for an unknown metric type")
+	}
+}
+
+func TestMetricCountAnnotation(t *testing.T) {
+	averageValue := resource.MustParse("1k")
+	hpa := newHPA("test",
+		resourceUtilizationMetric(v1.ResourceCPU, 80),
+		resourceAverageValueMetric(v1.ResourceMemory, "512Mi"),
+		v2.MetricSpec{
+			Type: v2.PodsMetricSourceType,
+			Pods: &v2.PodsMetricSource{
+				Metric: v2.MetricIdentifier{Name: "packets-per-second"},
+				Target: v2.MetricTarget{Type: v2.AverageValueMetricType, AverageValue: &averageValue},
+			},
+		})
+
+	if count := ComputeAnnotations(hpa, AnnotationOptions{})["metricCount"]; count != "3" {
+		t.Errorf("expected metricCount 3, got %q", count)
+	}
+	if count := ComputeAnnotations(newHPA("test"), AnnotationOptions{})["metricCount"]; count != "0" {
+		t.Errorf("expected metricCount 0 without metrics, got %q", count)
+	}
+}
+
+func TestAnnotationsMemoryUtilizationAndValue(t *testing.T) {
+	hpa := newHPA("test",
+		resourceUtilizationMetric(v1.ResourceMemory, 70),
+		resourceAverageValueMetric(v1.ResourceMemory, "512Mi"))
+
+	v := newTestController()
+	m := v.annotations(hpa)
+
+	expected := map[string]string{
+		"memoryTargetUtilization": "70",
+		"memoryTargetValue":       "512Mi",
+		"metricsSummary":          "mem=512Mi,mem=70%",
+	}
+	for key, value := range expected {
+		if m[key] != value {
+			t.Errorf("expected %s=%s, got %q", key, value, m[key])
+		}
+	}
+}
+
+func TestAnnotationsDisabledResources(t *testing.T) {
+	usage := resource.MustParse("300Mi")
+	utilization := int32(65)
+	hpa := newHPA("test",
+		resourceUtilizationMetric(v1.ResourceCPU, 80),
+		resourceAverageValueMetric(v1.ResourceMemory, "512Mi"))
+	hpa.Status.CurrentMetrics = []v2.MetricStatus{
+		{
+			Type:     v2.ResourceMetricSourceType,
+			Resource: &v2.ResourceMetricStatus{Name: v1.ResourceCPU, Current: v2.MetricValueStatus{AverageUtilization: &utilization}},
+		},
+		{
+			Type:     v2.ResourceMetricSourceType,
+			Resource: &v2.ResourceMetricStatus{Name: v1.ResourceMemory, Current: v2.MetricValueStatus{AverageValue: &usage}},
+		},
+	}
+
+	v := newTestController(WithDisabledResources(v1.ResourceMemory), WithStatusAnnotations())
+	m := v.annotations(hpa)
+
+	for key := range m {
+		if strings.Contains(strings.ToLower(key), "memory") {
+			t.Errorf("expected no memory annotations, got %q", key)
+		}
+	}
+	expected := map[string]string{
+		"cpuTargetUtilization":  "80",
+		"currentCpuUtilization": "65",
+		"metricsSummary":        "cpu=80%",
+	}
+	for key, value := range expected {
+		if m[key] != value {
+			t.Errorf("expected %s=%s, got %q", key, value, m[key])
+		}
+	}
+}
+
+func TestStatusAnnotationsGenerationLag(t *testing.T) {
+	generation := func(n int64) *int64 { return &n }
+
+	tests := []struct {
+		name     string
+		observed *int64
+		expected bool
+	}{
+		{name: "not observed yet"},
+		{name: "observed generation", observed: generation(3)},
+		{name: "mismatched generation", observed: generation(2), expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test")
+			hpa.Generation = 3
+			hpa.Status.ObservedGeneration = test.observed
+
+			m := make(map[string]string)
+			statusAnnotations(m, hpa)
+			if lag, ok := m["generationLag"]; ok != test.expected || (ok && lag != "true") {
+				t.Errorf("expected generationLag %v, got %v", test.expected, m)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// patchBatcher coalesces the desired annotations of the hpas within a window,
+// only the latest desired annotations of a hpa are kept until they're flushed.
+type patchBatcher struct {
+	sync.Mutex
+	window      time.Duration
+	concurrency int
+	// pending are the desired annotations keyed by namespace and hpa key.
+	pending map[string]map[string]map[string]string
+	// stopped is set once the final batch is taken, the annotations are patched directly afterwards.
+	stopped bool
+}
+
+func newPatchBatcher(window time.Duration, concurrency int) *patchBatcher {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &patchBatcher{
+		window:      window,
+		concurrency: concurrency,
+		pending:     make(map[string]map[string]map[string]string),
+	}
+}
+
+// add replaces the pending annotations of the hpa, it returns false if they can't be batched
+// and have to be patched directly, e.g. once the batcher is stopped.
+func (b *patchBatcher) add(key string, desired map[string]string) bool {
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.stopped {
+		return false
+	}
+	if b.pending[namespace] == nil {
+		b.pending[namespace] = make(map[string]map[string]string)
+	}
+	b.pending[namespace][key] = desired
+	return true
+}
+
+// take returns the pending annotations and resets them.
+func (b *patchBatcher) take() map[string]map[string]map[string]string {
+	b.Lock()
+	defer b.Unlock()
+	pending := b.pending
+	b.pending = make(map[string]map[string]map[string]string)
+	return pending
+}
+
+// stop returns the pending annotations, no more annotations are batched afterwards.
+func (b *patchBatcher) stop() map[string]map[string]map[string]string {
+	b.Lock()
+	defer b.Unlock()
+	pending := b.pending
+	b.pending = make(map[string]map[string]map[string]string)
+	b.stopped = true
+	return pending
+}
+
+// runBatcher flushes the pending annotations every window until stopCh is closed,
+// each flush is bounded by reconcileTimeout if set.
+func (v *HPAController) runBatcher(stopCh <-chan struct{}) {
+	ticker := v.clock.NewTicker(v.batcher.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C():
+			func() {
+				ctx := context.Background()
+				if v.reconcileTimeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, v.reconcileTimeout)
+					defer cancel()
+				}
+				v.flushBatch(ctx)
+			}()
+		}
+	}
+}
+
+// flushBatch patches the hpas with their pending annotations and records the results of their syncs,
+// the failed hpas are retried or dropped like the ones patched directly.
+func (v *HPAController) flushBatch(ctx context.Context) {
+	v.flushPending(ctx, v.batcher.take(), func(key string, err error) {
+		v.syncDone(key, classifyError(err))
+	})
+}
+
+// flushFinalBatch stops the batcher and patches the hpas with their last pending annotations before
+// the queue is drained, within shutdownTimeout. The failed hpas are only logged, all the hpas are
+// synced again on the next start.
+func (v *HPAController) flushFinalBatch() {
+	ctx, cancel := context.WithTimeout(context.Background(), v.shutdownTimeout)
+	defer cancel()
+	v.flushPending(ctx, v.batcher.stop(), nil)
+}
+
+// flushPending patches the hpas with the pending annotations namespace by namespace,
+// at most concurrency patches are in flight. The results are passed to done if set.
+func (v *HPAController) flushPending(ctx context.Context, pending map[string]map[string]map[string]string, done func(key string, err error)) {
+
+	namespaces := make([]string, 0, len(pending))
+	for namespace := range pending {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	for _, namespace := range namespaces {
+		sem := make(chan struct{}, v.batcher.concurrency)
+		var wg sync.WaitGroup
+		for key, desired := range pending[namespace] {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(key string, desired map[string]string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				err := v.flushHPA(ctx, key, desired)
+				if err != nil {
+					klog.ErrorS(err, "Failed to flush the hpa annotations", "key", key)
+				}
+				if done != nil {
+					done(key, err)
+				}
+			}(key, desired)
+		}
+		wg.Wait()
+	}
+}
+
+func (v *HPAController) flushHPA(ctx context.Context, key string, desired map[string]string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	hpa, err := v.hpaLister.HorizontalPodAutoscalers(namespace).Get(name)
+	if err != nil {
+		// has been deleted
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	_, err = v.applyAnnotations(ctx, key, hpa, desired)
+	return err
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	core "k8s.io/client-go/testing"
+)
+
+func TestBatchingCoalescesBursts(t *testing.T) {
+	a := newHPA("a", resourceUtilizationMetric(v1.ResourceCPU, 50))
+	b := newHPA("b", resourceUtilizationMetric(v1.ResourceCPU, 50))
+	c := newHPA("c", resourceUtilizationMetric(v1.ResourceCPU, 50))
+	c.Namespace = "other"
+	hpas := []*v2.HorizontalPodAutoscaler{a, b, c}
+	f := newFixtureWithOptions(t, []Option{WithBatching(time.Minute, 2)}, hpas...)
+
+	// a burst of spec changes, only the last one should be written
+	for utilization := int32(51); utilization <= 60; utilization++ {
+		for _, hpa := range hpas {
+			hpa = hpa.DeepCopy()
+			hpa.Spec.Metrics = []v2.MetricSpec{resourceUtilizationMetric(v1.ResourceCPU, utilization)}
+			f.updateLister(hpa)
+			f.sync(hpa)
+		}
+	}
+	if patches := f.patchActions(); len(patches) != 0 {
+		t.Fatalf("expected no patch before the batch is flushed, got %d", len(patches))
+	}
+
+	f.controller.flushBatch(context.Background())
+
+	if patches := f.patchActions(); len(patches) != len(hpas) {
+		t.Errorf("expected %d coalesced patches, got %d", len(hpas), len(patches))
+	}
+	for _, hpa := range hpas {
+		if got := f.get(hpa).Annotations["cpuTargetUtilization"]; got != "60" {
+			t.Errorf("expected %s/%s to be annotated with the latest cpuTargetUtilization 60, got %q", hpa.Namespace, hpa.Name, got)
+		}
+	}
+
+	// nothing is pending anymore
+	f.controller.flushBatch(context.Background())
+	if patches := f.patchActions(); len(patches) != len(hpas) {
+		t.Errorf("expected no more patches after the batch is flushed, got %d", len(patches)-len(hpas))
+	}
+}
+
+func TestBatchingKeepsLatestDesiredState(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithBatching(time.Minute, 1)}, hpa)
+
+	f.sync(hpa)
+	f.controller.flushBatch(context.Background())
+	f.updateLister(f.get(hpa))
+
+	// the spec is changed and reverted before the batch is flushed
+	changed := f.get(hpa)
+	changed.Spec.Metrics = []v2.MetricSpec{resourceUtilizationMetric(v1.ResourceCPU, 50)}
+	f.updateLister(changed)
+	f.sync(changed)
+	f.updateLister(f.get(hpa))
+	f.sync(hpa)
+
+	f.controller.flushBatch(context.Background())
+
+	if got := f.get(hpa).Annotations["cpuTargetUtilization"]; got != "80" {
+		t.Errorf("expected cpuTargetUtilization 80, got %q", got)
+	}
+	if patches := f.patchActions(); len(patches) != 1 {
+		t.Errorf("expected the reverted change not to be patched, got %d patches", len(patches))
+	}
+}
+
+func TestBatchingFlushesPendingOnStop(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithBatching(time.Hour, 1)}, hpa)
+	// the final flush runs before the queue is shut down
+	var flushedAfterShutdown atomic.Bool
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		if f.controller.queue.ShuttingDown() {
+			flushedAfterShutdown.Store(true)
+		}
+		return false, nil, nil
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- f.controller.RunWithContext(ctx, 1)
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		f.controller.batcher.Lock()
+		defer f.controller.batcher.Unlock()
+		return len(f.controller.batcher.pending) == 1, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the hpa to be batched: %v", err)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("RunWithContext didn't return after cancel")
+	}
+	if flushedAfterShutdown.Load() {
+		t.Error("expected the pending annotations to be flushed before the queue is shut down")
+	}
+	if !f.controller.batcher.stopped {
+		t.Error("expected the batcher to be stopped")
+	}
+	if got := f.get(hpa).Annotations["cpuTargetUtilization"]; got != "80" {
+		t.Errorf("expected the pending annotations to be written on stop, got %q", got)
+	}
+}
+
+func TestBatchingDropsFailedFlushesAfterMaxRetries(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	var dropped []string
+	f := newFixtureWithOptions(t, []Option{
+		WithBatching(time.Hour, 1),
+		WithMaxRetries(2),
+		WithDeadLetterHandler(func(key string, err error) { dropped = append(dropped, key) }),
+	}, hpa)
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("injected error")
+	})
+
+	f.controller.enqueueHPA(hpa)
+	for i := 0; i <= 2; i++ {
+		if !f.controller.processNextWorkItem(context.Background()) {
+			t.Fatalf("expected the queue to be running")
+		}
+		if requeues := f.controller.queue.NumRequeues("default/test"); requeues != i {
+			t.Errorf("expected the batched sync to keep %d requeues, got %d", i, requeues)
+		}
+		f.controller.flushBatch(context.Background())
+	}
+
+	if patches := f.patchActions(); len(patches) != 3 {
+		t.Errorf("expected 3 failed patches, got %d", len(patches))
+	}
+	if !reflect.DeepEqual(dropped, []string{"default/test"}) {
+		t.Errorf("expected the hpa to be dropped after the max retries, got %v", dropped)
+	}
+	if l := f.controller.queue.Len(); l != 0 {
+		t.Errorf("expected the dropped hpa not to be requeued, got %d queued", l)
+	}
+}
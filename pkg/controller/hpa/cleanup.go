@@ -0,0 +1,91 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// cleanup removes the managed annotations of all the hpas once the workers are stopped,
+// it gives up after shutdownTimeout.
+func (v *HPAController) cleanup() {
+	ctx, cancel := context.WithTimeout(context.Background(), v.shutdownTimeout)
+	defer cancel()
+
+	hpas, err := v.hpaLister.List(labels.Everything())
+	if err != nil {
+		klog.ErrorS(err, "Failed to list the hpas to clean up")
+		return
+	}
+
+	klog.InfoS("Removing the managed annotations of the hpas", "count", len(hpas))
+	for _, hpa := range hpas {
+		if v.ignored(hpa) {
+			continue
+		}
+		if err := v.removeAnnotations(ctx, hpa.Namespace, hpa.Name); err != nil {
+			if ctx.Err() != nil {
+				klog.InfoS("Timed out removing the managed annotations of the hpas", "timeout", v.shutdownTimeout)
+				return
+			}
+			klog.ErrorS(err, "Failed to remove the managed annotations of hpa", "namespace", hpa.Namespace, "name", hpa.Name)
+		}
+	}
+}
+
+// removeAnnotations removes the managed annotations written to the live hpa, along with the record of them.
+func (v *HPAController) removeAnnotations(ctx context.Context, namespace, name string) error {
+	hpa, err := v.getHPA(ctx, namespace, name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	patch := v.annotationsPatch(hpa.Annotations, map[string]string{})
+	delete(patch, writtenAnnotationsAnnotation)
+	if _, ok := hpa.Annotations[writtenAnnotationsAnnotation]; ok {
+		patch[writtenAnnotationsAnnotation] = nil
+	}
+	if len(patch) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": patch,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if v.dryRun {
+		klog.InfoS("Dry run, skip removing the managed annotations of hpa", "namespace", namespace, "name", name, "patch", string(data))
+		return nil
+	}
+
+	_, err = v.patchHPA(ctx, namespace, name, types.MergePatchType, data, metav1.PatchOptions{})
+	return err
+}
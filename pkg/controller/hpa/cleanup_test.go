@@ -0,0 +1,98 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestRunCleansUpOnStop(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	hpa.Annotations = map[string]string{"owner": "team"}
+	paused := newHPA("paused", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	paused.Annotations = map[string]string{pausedAnnotation: "true", "cpuTargetUtilization": "60"}
+	f := newFixtureWithOptions(t, []Option{WithCleanupOnStop(), WithReconcileTimestamp()}, hpa, paused)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+
+	done := make(chan error)
+	runStopCh := make(chan struct{})
+	go func() {
+		done <- f.controller.Run(1, runStopCh)
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return f.get(hpa).Annotations["cpuTargetUtilization"] == "80", nil
+	})
+	if err != nil {
+		t.Fatalf("hpa wasn't annotated: %v", err)
+	}
+
+	close(runStopCh)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("Run didn't return")
+	}
+
+	if got := f.get(hpa).Annotations; !reflect.DeepEqual(got, map[string]string{"owner": "team"}) {
+		t.Errorf("expected only the foreign annotations to be kept, got %v", got)
+	}
+	if got := f.get(paused).Annotations; !reflect.DeepEqual(got, paused.Annotations) {
+		t.Errorf("expected the paused hpa to be left alone, got %v", got)
+	}
+}
+
+func TestRunKeepsAnnotationsOnStopByDefault(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+
+	runStopCh := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- f.controller.Run(1, runStopCh)
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return f.get(hpa).Annotations["cpuTargetUtilization"] == "80", nil
+	})
+	if err != nil {
+		t.Fatalf("hpa wasn't annotated: %v", err)
+	}
+	close(runStopCh)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := f.get(hpa).Annotations["cpuTargetUtilization"]; got != "80" {
+		t.Errorf("expected the annotations to be kept without WithCleanupOnStop, got %q", got)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The annotations are computed from the metrics converted into the version independent
+// form below, so supporting another autoscaling version only needs another conversion.
+
+// metricSourceType is the type of the source of a metric.
+type metricSourceType string
+
+const (
+	resourceSourceType          metricSourceType = "Resource"
+	containerResourceSourceType metricSourceType = "ContainerResource"
+	podsSourceType              metricSourceType = "Pods"
+	objectSourceType            metricSourceType = "Object"
+	externalSourceType          metricSourceType = "External"
+)
+
+// metricValueType is the type of a metric target, it's empty for the observed values.
+type metricValueType string
+
+const (
+	utilizationValueType  metricValueType = "Utilization"
+	valueValueType        metricValueType = "Value"
+	averageValueValueType metricValueType = "AverageValue"
+)
+
+// metric is a metric of the spec or of the status of a hpa.
+type metric struct {
+	source metricSourceType
+
+	// resource and container identify the Resource and ContainerResource metrics.
+	resource  v1.ResourceName
+	container string
+
+	// name and selector identify the Pods, Object and External metrics.
+	name     string
+	selector *metav1.LabelSelector
+
+	// describedObject is the object described by the Object metrics.
+	describedObject objectReference
+
+	// value is the target of the metrics of the spec, or the observed value of the metrics of the status.
+	value metricValue
+}
+
+type objectReference struct {
+	apiVersion string
+	kind       string
+	name       string
+}
+
+type metricValue struct {
+	valueType          metricValueType
+	value              *resource.Quantity
+	averageValue       *resource.Quantity
+	averageUtilization *int32
+}
+
+// metricsFromV2 converts the autoscaling/v2 metric specs, the metrics of unknown sources are dropped.
+func metricsFromV2(specs []v2.MetricSpec) []metric {
+	metrics := make([]metric, 0, len(specs))
+	for _, spec := range specs {
+		switch {
+		case spec.Resource != nil:
+			metrics = append(metrics, metric{
+				source:   resourceSourceType,
+				resource: spec.Resource.Name,
+				value:    targetFromV2(spec.Resource.Target),
+			})
+		case spec.ContainerResource != nil:
+			metrics = append(metrics, metric{
+				source:    containerResourceSourceType,
+				resource:  spec.ContainerResource.Name,
+				container: spec.ContainerResource.Container,
+				value:     targetFromV2(spec.ContainerResource.Target),
+			})
+		case spec.Pods != nil:
+			metrics = append(metrics, metric{
+				source:   podsSourceType,
+				name:     spec.Pods.Metric.Name,
+				selector: spec.Pods.Metric.Selector,
+				value:    targetFromV2(spec.Pods.Target),
+			})
+		case spec.Object != nil:
+			metrics = append(metrics, metric{
+				source:          objectSourceType,
+				name:            spec.Object.Metric.Name,
+				selector:        spec.Object.Metric.Selector,
+				describedObject: objectReferenceFromV2(spec.Object.DescribedObject),
+				value:           targetFromV2(spec.Object.Target),
+			})
+		case spec.External != nil:
+			metrics = append(metrics, metric{
+				source:   externalSourceType,
+				name:     spec.External.Metric.Name,
+				selector: spec.External.Metric.Selector,
+				value:    targetFromV2(spec.External.Target),
+			})
+		}
+	}
+	return metrics
+}
+
+// metricStatusesFromV2 converts the autoscaling/v2 metric statuses, the metrics of unknown sources are dropped.
+func metricStatusesFromV2(statuses []v2.MetricStatus) []metric {
+	metrics := make([]metric, 0, len(statuses))
+	for _, status := range statuses {
+		switch {
+		case status.Resource != nil:
+			metrics = append(metrics, metric{
+				source:   resourceSourceType,
+				resource: status.Resource.Name,
+				value:    currentFromV2(status.Resource.Current),
+			})
+		case status.ContainerResource != nil:
+			metrics = append(metrics, metric{
+				source:    containerResourceSourceType,
+				resource:  status.ContainerResource.Name,
+				container: status.ContainerResource.Container,
+				value:     currentFromV2(status.ContainerResource.Current),
+			})
+		case status.Pods != nil:
+			metrics = append(metrics, metric{
+				source:   podsSourceType,
+				name:     status.Pods.Metric.Name,
+				selector: status.Pods.Metric.Selector,
+				value:    currentFromV2(status.Pods.Current),
+			})
+		case status.Object != nil:
+			metrics = append(metrics, metric{
+				source:          objectSourceType,
+				name:            status.Object.Metric.Name,
+				selector:        status.Object.Metric.Selector,
+				describedObject: objectReferenceFromV2(status.Object.DescribedObject),
+				value:           currentFromV2(status.Object.Current),
+			})
+		case status.External != nil:
+			metrics = append(metrics, metric{
+				source:   externalSourceType,
+				name:     status.External.Metric.Name,
+				selector: status.External.Metric.Selector,
+				value:    currentFromV2(status.External.Current),
+			})
+		}
+	}
+	return metrics
+}
+
+func targetFromV2(target v2.MetricTarget) metricValue {
+	return metricValue{
+		valueType:          metricValueType(target.Type),
+		value:              target.Value,
+		averageValue:       target.AverageValue,
+		averageUtilization: target.AverageUtilization,
+	}
+}
+
+func currentFromV2(current v2.MetricValueStatus) metricValue {
+	return metricValue{
+		value:              current.Value,
+		averageValue:       current.AverageValue,
+		averageUtilization: current.AverageUtilization,
+	}
+}
+
+func objectReferenceFromV2(ref v2.CrossVersionObjectReference) objectReference {
+	return objectReference{
+		apiVersion: ref.APIVersion,
+		kind:       ref.Kind,
+		name:       ref.Name,
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"reflect"
+	"testing"
+
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMetricsFromV2(t *testing.T) {
+	utilization := int32(80)
+	averageValue := resource.MustParse("100")
+	value := resource.MustParse("2k")
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+
+	tests := []struct {
+		name     string
+		spec     v2.MetricSpec
+		expected metric
+	}{
+		{
+			name: "resource",
+			spec: v2.MetricSpec{
+				Type: v2.ResourceMetricSourceType,
+				Resource: &v2.ResourceMetricSource{
+					Name:   v1.ResourceCPU,
+					Target: v2.MetricTarget{Type: v2.UtilizationMetricType, AverageUtilization: &utilization},
+				},
+			},
+			expected: metric{
+				source:   resourceSourceType,
+				resource: v1.ResourceCPU,
+				value:    metricValue{valueType: utilizationValueType, averageUtilization: &utilization},
+			},
+		},
+		{
+			name: "pods",
+			spec: v2.MetricSpec{
+				Type: v2.PodsMetricSourceType,
+				Pods: &v2.PodsMetricSource{
+					Metric: v2.MetricIdentifier{Name: "requests_per_second", Selector: selector},
+					Target: v2.MetricTarget{Type: v2.AverageValueMetricType, AverageValue: &averageValue},
+				},
+			},
+			expected: metric{
+				source:   podsSourceType,
+				name:     "requests_per_second",
+				selector: selector,
+				value:    metricValue{valueType: averageValueValueType, averageValue: &averageValue},
+			},
+		},
+		{
+			name: "object",
+			spec: v2.MetricSpec{
+				Type: v2.ObjectMetricSourceType,
+				Object: &v2.ObjectMetricSource{
+					DescribedObject: v2.CrossVersionObjectReference{APIVersion: "networking.k8s.io/v1", Kind: "Ingress", Name: "main-route"},
+					Metric:          v2.MetricIdentifier{Name: "requests"},
+					Target:          v2.MetricTarget{Type: v2.ValueMetricType, Value: &value},
+				},
+			},
+			expected: metric{
+				source:          objectSourceType,
+				name:            "requests",
+				describedObject: objectReference{apiVersion: "networking.k8s.io/v1", kind: "Ingress", name: "main-route"},
+				value:           metricValue{valueType: valueValueType, value: &value},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics := metricsFromV2([]v2.MetricSpec{test.spec})
+			if len(metrics) != 1 {
+				t.Fatalf("expected 1 metric, got %d", len(metrics))
+			}
+			if !reflect.DeepEqual(metrics[0], test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, metrics[0])
+			}
+		})
+	}
+}
+
+func TestMetricsFromV2DropsUnknownSources(t *testing.T) {
+	metrics := metricsFromV2([]v2.MetricSpec{{Type: "Unknown"}, resourceUtilizationMetric(v1.ResourceCPU, 80)})
+	if len(metrics) != 1 || metrics[0].source != resourceSourceType {
+		t.Errorf("expected only the resource metric, got %+v", metrics)
+	}
+}
+
+func TestMetricStatusesFromV2(t *testing.T) {
+	utilization := int32(65)
+	statuses := []v2.MetricStatus{{
+		Type: v2.ResourceMetricSourceType,
+		Resource: &v2.ResourceMetricStatus{
+			Name:    v1.ResourceCPU,
+			Current: v2.MetricValueStatus{AverageUtilization: &utilization},
+		},
+	}}
+
+	expected := []metric{{
+		source:   resourceSourceType,
+		resource: v1.ResourceCPU,
+		value:    metricValue{averageUtilization: &utilization},
+	}}
+	if metrics := metricStatusesFromV2(statuses); !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("expected %+v, got %+v", expected, metrics)
+	}
+}
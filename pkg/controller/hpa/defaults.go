@@ -0,0 +1,136 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// percentSuffixDefault is the key of the ConfigMap rendering the utilization targets with a % suffix, e.g. "true".
+	percentSuffixDefault = "percentSuffix"
+	// disabledResourcesDefault is the key of the ConfigMap listing the resources whose metrics aren't annotated, e.g. "memory,storage".
+	disabledResourcesDefault = "disabledResources"
+)
+
+// annotationDefaults are the annotation settings which can be changed at runtime by a ConfigMap.
+type annotationDefaults struct {
+	percentSuffix     bool
+	disabledResources []v1.ResourceName
+}
+
+// configMapDefaults keeps the annotation defaults in sync with a ConfigMap, the settings of the
+// options are used for the keys missing from the ConfigMap, or when the ConfigMap doesn't exist.
+type configMapDefaults struct {
+	namespace string
+	name      string
+	informer  coreinformers.ConfigMapInformer
+
+	lock    sync.RWMutex
+	static  annotationDefaults
+	current annotationDefaults
+}
+
+// get returns the current annotation defaults.
+func (d *configMapDefaults) get() annotationDefaults {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.current
+}
+
+// parseDefaults overrides the static defaults with the settings of the ConfigMap data.
+func parseDefaults(static annotationDefaults, data map[string]string) (annotationDefaults, error) {
+	defaults := static
+	if value, ok := data[percentSuffixDefault]; ok {
+		percentSuffix, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return defaults, fmt.Errorf("invalid %s %q: %v", percentSuffixDefault, value, err)
+		}
+		defaults.percentSuffix = percentSuffix
+	}
+	if value, ok := data[disabledResourcesDefault]; ok {
+		defaults.disabledResources = nil
+		for _, resource := range strings.Split(value, ",") {
+			resource = strings.TrimSpace(resource)
+			if resource == "" {
+				continue
+			}
+			if strings.ContainsAny(resource, " \t\n") {
+				return static, fmt.Errorf("invalid %s %q: malformed resource %q", disabledResourcesDefault, value, resource)
+			}
+			defaults.disabledResources = append(defaults.disabledResources, v1.ResourceName(resource))
+		}
+	}
+	return defaults, nil
+}
+
+// watchDefaults updates the annotation defaults when the ConfigMap changes and resyncs all the hpas,
+// the prior settings are kept when the ConfigMap is malformed.
+func (v *HPAController) watchDefaults() {
+	d := v.defaults
+	d.static = annotationDefaults{percentSuffix: v.percentSuffix, disabledResources: v.disabledResources}
+	d.current = d.static
+
+	d.informer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			cm, ok := obj.(*v1.ConfigMap)
+			return ok && cm.Namespace == d.namespace && cm.Name == d.name
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				v.updateDefaults(obj.(*v1.ConfigMap).Data)
+			},
+			UpdateFunc: func(_, cur interface{}) {
+				v.updateDefaults(cur.(*v1.ConfigMap).Data)
+			},
+			DeleteFunc: func(interface{}) {
+				v.updateDefaults(nil)
+			},
+		},
+	})
+}
+
+func (v *HPAController) updateDefaults(data map[string]string) {
+	d := v.defaults
+	defaults, err := parseDefaults(d.static, data)
+	if err != nil {
+		klog.ErrorS(err, "Failed to parse the annotation defaults, keeping the prior ones", "namespace", d.namespace, "name", d.name)
+		return
+	}
+
+	d.lock.Lock()
+	d.current = defaults
+	d.lock.Unlock()
+	klog.V(2).InfoS("Updated the annotation defaults", "namespace", d.namespace, "name", d.name,
+		"percentSuffix", defaults.percentSuffix, "disabledResources", defaults.disabledResources)
+
+	if err := v.ResyncAll(); err != nil {
+		utilruntime.HandleError(err)
+	}
+}
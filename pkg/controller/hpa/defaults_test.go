@@ -0,0 +1,163 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseDefaults(t *testing.T) {
+	static := annotationDefaults{disabledResources: []v1.ResourceName{v1.ResourceStorage}}
+	tests := []struct {
+		name     string
+		data     map[string]string
+		expected annotationDefaults
+		err      bool
+	}{
+		{
+			name:     "empty",
+			expected: static,
+		},
+		{
+			name:     "overrides",
+			data:     map[string]string{percentSuffixDefault: "true", disabledResourcesDefault: "memory, cpu"},
+			expected: annotationDefaults{percentSuffix: true, disabledResources: []v1.ResourceName{v1.ResourceMemory, v1.ResourceCPU}},
+		},
+		{
+			name:     "no disabled resources",
+			data:     map[string]string{disabledResourcesDefault: ""},
+			expected: annotationDefaults{},
+		},
+		{
+			name: "malformed percent suffix",
+			data: map[string]string{percentSuffixDefault: "yes please"},
+			err:  true,
+		},
+		{
+			name: "malformed resources",
+			data: map[string]string{disabledResourcesDefault: "memory cpu"},
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseDefaults(static, test.data)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestDefaultsConfigMapUpdatesAnnotations(t *testing.T) {
+	cmClient := k8sfake.NewSimpleClientset()
+	cmInformers := kubeinformers.NewSharedInformerFactory(cmClient, 0)
+	opts := []Option{WithDefaultsConfigMap(cmInformers.Core().V1().ConfigMaps(), "kubesphere-system", "hpa-defaults")}
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80), resourceUtilizationMetric(v1.ResourceMemory, 60))
+	f := newFixtureWithOptions(t, opts, hpa)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	cmInformers.Start(stopCh)
+	cmInformers.WaitForCacheSync(stopCh)
+
+	f.sync(hpa)
+	if got := f.get(hpa).Annotations; got["cpuTargetUtilization"] != "80" || got["memoryTargetUtilization"] != "60" {
+		t.Fatalf("expected the static defaults without the ConfigMap, got %v", got)
+	}
+
+	// waitForDefaults waits until the ConfigMap is observed and drains the resynced hpas
+	waitForDefaults := func(expected annotationDefaults) {
+		t.Helper()
+		err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			return reflect.DeepEqual(f.controller.defaults.get(), expected), nil
+		})
+		if err != nil {
+			t.Fatalf("expected the defaults %+v, got %+v", expected, f.controller.defaults.get())
+		}
+		for f.controller.queue.Len() > 0 {
+			key, _ := f.controller.queue.Get()
+			f.controller.queue.Done(key)
+		}
+		// the next sync prunes the annotations written by the previous one
+		f.updateLister(f.get(hpa))
+	}
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kubesphere-system", Name: "hpa-defaults"},
+		Data:       map[string]string{percentSuffixDefault: "true", disabledResourcesDefault: "memory"},
+	}
+	cm, err := cmClient.CoreV1().ConfigMaps(cm.Namespace).Create(context.Background(), cm, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForDefaults(annotationDefaults{percentSuffix: true, disabledResources: []v1.ResourceName{v1.ResourceMemory}})
+
+	f.sync(hpa)
+	got := f.get(hpa).Annotations
+	if got["cpuTargetUtilization"] != "80%" {
+		t.Errorf("expected the percent suffix of the ConfigMap, got %v", got)
+	}
+	if _, ok := got["memoryTargetUtilization"]; ok {
+		t.Errorf("expected the memory metrics to be disabled by the ConfigMap, got %v", got)
+	}
+
+	// the malformed ConfigMap is ignored
+	cm.Data = map[string]string{percentSuffixDefault: "maybe"}
+	if _, err := cmClient.CoreV1().ConfigMaps(cm.Namespace).Update(context.Background(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		obj, exists, err := cmInformers.Core().V1().ConfigMaps().Informer().GetIndexer().GetByKey("kubesphere-system/hpa-defaults")
+		return exists && err == nil && obj.(*v1.ConfigMap).Data[percentSuffixDefault] == "maybe", err
+	})
+	if err != nil {
+		t.Fatalf("malformed ConfigMap not observed: %v", err)
+	}
+	if got := f.controller.defaults.get(); !got.percentSuffix {
+		t.Errorf("expected the prior defaults to be kept, got %+v", got)
+	}
+
+	if err := cmClient.CoreV1().ConfigMaps(cm.Namespace).Delete(context.Background(), cm.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForDefaults(annotationDefaults{})
+
+	f.sync(hpa)
+	if got := f.get(hpa).Annotations; got["cpuTargetUtilization"] != "80" || got["memoryTargetUtilization"] != "60" {
+		t.Errorf("expected the static defaults once the ConfigMap is deleted, got %v", got)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var (
+	// ErrConflict is returned when the hpa was modified concurrently, the sync is retried.
+	ErrConflict = errors.New("conflict")
+	// ErrTransient is returned when the sync failed for a reason which may go away, the sync is retried.
+	ErrTransient = errors.New("transient error")
+	// ErrInvalidSpec is returned when the hpa or the patch is invalid, the sync isn't retried.
+	ErrInvalidSpec = errors.New("invalid spec")
+
+	// errPending is returned when the annotations are batched, the sync neither succeeded nor failed
+	// until the batch is flushed.
+	errPending = errors.New("annotations pending in the batch")
+)
+
+// syncError classifies the error of a sync, errors.Is matches both the class and the wrapped error.
+type syncError struct {
+	class error
+	err   error
+}
+
+func (e *syncError) Error() string {
+	return e.class.Error() + ": " + e.err.Error()
+}
+
+func (e *syncError) Unwrap() error {
+	return e.err
+}
+
+func (e *syncError) Is(target error) bool {
+	return target == e.class
+}
+
+// classifyError wraps err with ErrConflict, ErrInvalidSpec or ErrTransient.
+func classifyError(err error) error {
+	if err == nil || err == errPending {
+		return err
+	}
+
+	var classified *syncError
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	switch {
+	case apierrors.IsConflict(err):
+		return &syncError{class: ErrConflict, err: err}
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		return &syncError{class: ErrInvalidSpec, err: err}
+	default:
+		return &syncError{class: ErrTransient, err: err}
+	}
+}
+
+// invalidSpec returns an error classified as ErrInvalidSpec.
+func invalidSpec(err error) error {
+	return &syncError{class: ErrInvalidSpec, err: err}
+}
+
+// retriable returns false if retrying the sync can't help.
+func retriable(err error) bool {
+	return !errors.Is(err, ErrInvalidSpec)
+}
+
+// fixedDelayRequeue requeues the hpas whose sync failed with the errors matched by match after delay.
+type fixedDelayRequeue struct {
+	match func(error) bool
+	delay time.Duration
+}
+
+// fixedDelay returns the delay of the first fixed delay requeue matching err.
+func (v *HPAController) fixedDelay(err error) (time.Duration, bool) {
+	for _, requeue := range v.fixedDelays {
+		if requeue.match(err) {
+			return requeue.delay, true
+		}
+	}
+	return 0, false
+}
+
+// attemptCounter counts the fixed delay requeues of the hpas.
+type attemptCounter struct {
+	sync.Mutex
+	attempts map[interface{}]int
+}
+
+func newAttemptCounter() *attemptCounter {
+	return &attemptCounter{attempts: make(map[interface{}]int)}
+}
+
+func (c *attemptCounter) get(key interface{}) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.attempts[key]
+}
+
+func (c *attemptCounter) inc(key interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	c.attempts[key]++
+}
+
+func (c *attemptCounter) forget(key interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.attempts, key)
+}
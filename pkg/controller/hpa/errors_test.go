@@ -0,0 +1,192 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestSyncErrorRetryPolicy(t *testing.T) {
+	resource := schema.GroupResource{Group: "autoscaling", Resource: "horizontalpodautoscalers"}
+	kind := schema.GroupKind{Group: "autoscaling", Kind: "HorizontalPodAutoscaler"}
+	replicas := int32(20)
+
+	tests := []struct {
+		name     string
+		patchErr error
+		invalid  bool
+		class    error
+		retried  bool
+	}{
+		{
+			name:     "conflict",
+			patchErr: apierrors.NewConflict(resource, "test", fmt.Errorf("the object has been modified")),
+			class:    ErrConflict,
+			retried:  true,
+		},
+		{
+			name:     "transient",
+			patchErr: apierrors.NewServerTimeout(resource, "patch", 1),
+			class:    ErrTransient,
+			retried:  true,
+		},
+		{
+			name:     "invalid patch",
+			patchErr: apierrors.NewInvalid(kind, "test", field.ErrorList{field.Invalid(field.NewPath("metadata", "annotations"), "", "invalid")}),
+			class:    ErrInvalidSpec,
+			retried:  false,
+		},
+		{
+			name:    "invalid spec",
+			invalid: true,
+			class:   ErrInvalidSpec,
+			retried: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+			if test.invalid {
+				hpa.Spec.MinReplicas = &replicas
+			}
+			var dropped []string
+			f := newFixtureWithOptions(t, []Option{WithDeadLetterHandler(func(key string, err error) {
+				dropped = append(dropped, key)
+			})}, hpa)
+			if test.patchErr != nil {
+				f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+					return true, nil, test.patchErr
+				})
+			}
+
+			key := hpa.Namespace + "/" + hpa.Name
+			err := f.controller.syncHPA(context.Background(), key)
+			if !errors.Is(err, test.class) {
+				t.Fatalf("expected error classified as %v, got %v", test.class, err)
+			}
+			if test.patchErr != nil && !errors.Is(err, test.patchErr) {
+				t.Errorf("expected the client error to be wrapped, got %v", err)
+			}
+
+			f.controller.handleErr(err, key)
+			if retried := f.controller.queue.NumRequeues(key) == 1; retried != test.retried {
+				t.Errorf("expected retried %v, got %v", test.retried, retried)
+			}
+			if test.retried == (len(dropped) == 1) {
+				t.Errorf("expected dropped %v, got %v", !test.retried, dropped)
+			}
+		})
+	}
+}
+
+// delaySpyQueue records the delayed and the rate limited requeues of the controller.
+type delaySpyQueue struct {
+	workqueue.RateLimitingInterface
+	delays      map[interface{}]time.Duration
+	rateLimited []interface{}
+}
+
+func (q *delaySpyQueue) AddAfter(item interface{}, duration time.Duration) {
+	q.delays[item] = duration
+	q.RateLimitingInterface.AddAfter(item, duration)
+}
+
+func (q *delaySpyQueue) AddRateLimited(item interface{}) {
+	q.rateLimited = append(q.rateLimited, item)
+	q.RateLimitingInterface.AddRateLimited(item)
+}
+
+func TestHandleErrRequeuesWithFixedDelay(t *testing.T) {
+	resource := schema.GroupResource{Group: "autoscaling", Resource: "horizontalpodautoscalers"}
+	conflicted := newHPA("conflicted", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	unavailable := newHPA("unavailable", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	delay := 5 * time.Second
+	f := newFixtureWithOptions(t, []Option{WithFixedDelayRequeue(func(err error) bool {
+		return errors.Is(err, ErrConflict)
+	}, delay)}, conflicted, unavailable)
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		if action.(core.PatchAction).GetName() == conflicted.Name {
+			return true, nil, apierrors.NewConflict(resource, conflicted.Name, fmt.Errorf("modified"))
+		}
+		return true, nil, apierrors.NewServiceUnavailable("unavailable")
+	})
+	queue := &delaySpyQueue{RateLimitingInterface: f.controller.queue, delays: map[interface{}]time.Duration{}}
+	f.controller.queue = queue
+
+	for _, hpa := range []*v2.HorizontalPodAutoscaler{conflicted, unavailable} {
+		key := hpa.Namespace + "/" + hpa.Name
+		f.controller.handleErr(f.controller.syncHPA(context.Background(), key), key)
+	}
+
+	conflictedKey := conflicted.Namespace + "/" + conflicted.Name
+	if got, ok := queue.delays[conflictedKey]; !ok || got != delay {
+		t.Errorf("expected %s requeued after %v, got %v (requeued %v)", conflictedKey, delay, got, ok)
+	}
+	if n := queue.NumRequeues(conflictedKey); n != 0 {
+		t.Errorf("expected the fixed delay requeue not to count as a retry, got %d", n)
+	}
+	unavailableKey := unavailable.Namespace + "/" + unavailable.Name
+	if len(queue.rateLimited) != 1 || queue.rateLimited[0] != unavailableKey {
+		t.Errorf("expected only %s rate limited, got %v", unavailableKey, queue.rateLimited)
+	}
+	if _, ok := queue.delays[unavailableKey]; ok {
+		t.Errorf("expected %s not requeued with the fixed delay", unavailableKey)
+	}
+}
+
+func TestHandleErrDropsFixedDelayRequeuesAfterMaxRetries(t *testing.T) {
+	var dropped []string
+	f := newFixtureWithOptions(t, []Option{
+		WithMaxRetries(2),
+		WithFixedDelayRequeue(func(err error) bool { return errors.Is(err, ErrTransient) }, time.Hour),
+		WithDeadLetterHandler(func(key string, err error) { dropped = append(dropped, key) }),
+	})
+
+	key := "default/test"
+	syncErr := classifyError(fmt.Errorf("injected error"))
+	for i := 0; i < 2; i++ {
+		f.controller.handleErr(syncErr, key)
+		if len(dropped) != 0 {
+			t.Fatalf("expected no dead letter before retries are exhausted, got %v after %d errors", dropped, i+1)
+		}
+	}
+	if attempts := f.controller.fixedDelayAttempts.get(key); attempts != 2 {
+		t.Errorf("expected 2 fixed delay attempts, got %d", attempts)
+	}
+
+	f.controller.handleErr(syncErr, key)
+	if len(dropped) != 1 || dropped[0] != key {
+		t.Fatalf("expected %s to be dropped after the max retries, got %v", key, dropped)
+	}
+	if attempts := f.controller.fixedDelayAttempts.get(key); attempts != 0 {
+		t.Errorf("expected the fixed delay attempts to be forgotten, got %d", attempts)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ExportAnnotations returns the managed annotations computed for the hpas of namespace keyed by hpa name,
+// without writing them, e.g. to preview them in the console. The hpas of all namespaces are returned
+// keyed by namespace/name when namespace is empty. The annotations reading other objects, such as the
+// current usage or the missing targets, aren't computed, and the hpas not synced by the controller are left out.
+func (v *HPAController) ExportAnnotations(namespace string) (map[string]map[string]string, error) {
+	hpas, err := v.hpaLister.HorizontalPodAutoscalers(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list hpas: %v", err)
+	}
+
+	exported := make(map[string]map[string]string, len(hpas))
+	for _, hpa := range hpas {
+		if v.ignored(hpa) {
+			continue
+		}
+		key := hpa.Name
+		if namespace == "" {
+			if key, err = cache.MetaNamespaceKeyFunc(hpa); err != nil {
+				return nil, err
+			}
+		}
+
+		annotations := v.annotations(hpa)
+		for name := range annotations {
+			if v.excludedAnnotation(name) {
+				delete(annotations, name)
+			}
+		}
+		exported[key] = annotations
+	}
+	return exported, nil
+}
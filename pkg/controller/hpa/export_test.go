@@ -0,0 +1,80 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestExportAnnotations(t *testing.T) {
+	minReplicas := int32(2)
+	cpu := newHPA("cpu", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	memory := newHPA("memory", resourceAverageValueMetric(v1.ResourceMemory, "512Mi"))
+	memory.Spec.MinReplicas = &minReplicas
+	memory.Status.CurrentReplicas = 3
+	paused := newHPA("paused", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	paused.Annotations = map[string]string{pausedAnnotation: "true"}
+	other := newHPA("other", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	other.Namespace = "other"
+	f := newFixtureWithOptions(t, []Option{WithExcludedKeys([]string{"metricCount"})}, cpu, memory, paused, other)
+
+	got, err := f.controller.ExportAnnotations(cpu.Namespace)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]map[string]string{
+		"cpu": {
+			"cpuTargetUtilization": "80",
+			"minReplicas":          "1",
+			"maxReplicas":          "10",
+			"replicaRange":         "1-10",
+			"metricsSummary":       "cpu=80%",
+			"scaleTargetRef":       "apps/v1/Deployment/cpu",
+		},
+		"memory": {
+			"memoryTargetValue": "512Mi",
+			"minReplicas":       "2",
+			"maxReplicas":       "10",
+			"replicaRange":      "2-10",
+			"metricsSummary":    "mem=512Mi",
+			"scaleTargetRef":    "apps/v1/Deployment/memory",
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if patches := f.patchActions(); len(patches) != 0 {
+		t.Errorf("expected no hpa to be patched, got %d patches", len(patches))
+	}
+
+	all, err := f.controller.ExportAnnotations("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, key := range []string{"default/cpu", "default/memory", "other/other"} {
+		if _, ok := all[key]; !ok {
+			t.Errorf("expected the annotations of %s to be exported, got %v", key, all)
+		}
+	}
+	if len(all) != 3 {
+		t.Errorf("expected 3 hpas, got %d", len(all))
+	}
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	v2 "k8s.io/api/autoscaling/v2"
+	"k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	clientset "k8s.io/client-go/kubernetes"
+	autoscalingv1listers "k8s.io/client-go/listers/autoscaling/v1"
+	v2listers "k8s.io/client-go/listers/autoscaling/v2"
+	v2beta2listers "k8s.io/client-go/listers/autoscaling/v2beta2"
+	"k8s.io/klog/v2"
+)
+
+// NewHPAControllerWithDiscovery creates a HPAController using the autoscaling API served by the cluster,
+// autoscaling/v2 is preferred, autoscaling/v2beta2 is used on older clusters and autoscaling/v1 as a last resort,
+// only the cpu utilization target is served by the latter.
+func NewHPAControllerWithDiscovery(informerFactory informers.SharedInformerFactory, client clientset.Interface, opts ...Option) (*HPAController, error) {
+	served, err := groupVersionServed(client, v2.SchemeGroupVersion.String())
+	if err != nil {
+		return nil, err
+	}
+	if served {
+		return NewHPAController(informerFactory.Autoscaling().V2().HorizontalPodAutoscalers(), client, opts...), nil
+	}
+
+	served, err = groupVersionServed(client, v2beta2.SchemeGroupVersion.String())
+	if err != nil {
+		return nil, err
+	}
+	if served {
+		klog.InfoS("Falling back to autoscaling/v2beta2, autoscaling/v2 is not served")
+		hpaInformer := informerFactory.Autoscaling().V2beta2().HorizontalPodAutoscalers()
+		return newHPAController(hpaInformer.Informer(), &v2beta2Lister{lister: hpaInformer.Lister()}, v2beta2.SchemeGroupVersion, client, opts...), nil
+	}
+
+	served, err = groupVersionServed(client, autoscalingv1.SchemeGroupVersion.String())
+	if err != nil {
+		return nil, err
+	}
+	if served {
+		klog.InfoS("Falling back to autoscaling/v1, neither autoscaling/v2 nor autoscaling/v2beta2 is served")
+		hpaInformer := informerFactory.Autoscaling().V1().HorizontalPodAutoscalers()
+		return newHPAController(hpaInformer.Informer(), &v1Lister{lister: hpaInformer.Lister()}, autoscalingv1.SchemeGroupVersion, client, opts...), nil
+	}
+
+	return nil, fmt.Errorf("none of %s, %s and %s is served by the cluster", v2.SchemeGroupVersion, v2beta2.SchemeGroupVersion, autoscalingv1.SchemeGroupVersion)
+}
+
+func groupVersionServed(client clientset.Interface, groupVersion string) (bool, error) {
+	resources, err := client.Discovery().ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, resource := range resources.APIResources {
+		if resource.Name == "horizontalpodautoscalers" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// patchHPA patches the hpa with the API version the controller is watching.
+func (v *HPAController) patchHPA(ctx context.Context, namespace, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) (metav1.Object, error) {
+	switch v.groupVersion {
+	case v2beta2.SchemeGroupVersion:
+		return v.client.AutoscalingV2beta2().HorizontalPodAutoscalers(namespace).Patch(ctx, name, pt, data, opts)
+	case autoscalingv1.SchemeGroupVersion:
+		return v.client.AutoscalingV1().HorizontalPodAutoscalers(namespace).Patch(ctx, name, pt, data, opts)
+	default:
+		return v.client.AutoscalingV2().HorizontalPodAutoscalers(namespace).Patch(ctx, name, pt, data, opts)
+	}
+}
+
+// getHPA reads the live hpa from the apiserver with the API version the controller is watching.
+func (v *HPAController) getHPA(ctx context.Context, namespace, name string) (*v2.HorizontalPodAutoscaler, error) {
+	switch v.groupVersion {
+	case v2beta2.SchemeGroupVersion:
+		hpa, err := v.client.AutoscalingV2beta2().HorizontalPodAutoscalers(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return convertV2beta2(hpa)
+	case autoscalingv1.SchemeGroupVersion:
+		hpa, err := v.client.AutoscalingV1().HorizontalPodAutoscalers(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return convertV1(hpa), nil
+	default:
+		return v.client.AutoscalingV2().HorizontalPodAutoscalers(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+}
+
+// convertV2beta2 converts a autoscaling/v2beta2 hpa to autoscaling/v2,
+// the two versions share the same serialized form so a json round trip is lossless.
+func convertV2beta2(in *v2beta2.HorizontalPodAutoscaler) (*v2.HorizontalPodAutoscaler, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &v2.HorizontalPodAutoscaler{}
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, err
+	}
+	out.APIVersion = v2.SchemeGroupVersion.String()
+	return out, nil
+}
+
+func convertV2beta2List(in []*v2beta2.HorizontalPodAutoscaler) ([]*v2.HorizontalPodAutoscaler, error) {
+	out := make([]*v2.HorizontalPodAutoscaler, 0, len(in))
+	for _, hpa := range in {
+		converted, err := convertV2beta2(hpa)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, converted)
+	}
+	return out, nil
+}
+
+// v2beta2Lister serves the autoscaling/v2beta2 hpas as autoscaling/v2.
+type v2beta2Lister struct {
+	lister v2beta2listers.HorizontalPodAutoscalerLister
+}
+
+func (l *v2beta2Lister) List(selector labels.Selector) ([]*v2.HorizontalPodAutoscaler, error) {
+	hpas, err := l.lister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	return convertV2beta2List(hpas)
+}
+
+func (l *v2beta2Lister) HorizontalPodAutoscalers(namespace string) v2listers.HorizontalPodAutoscalerNamespaceLister {
+	return &v2beta2NamespaceLister{lister: l.lister.HorizontalPodAutoscalers(namespace)}
+}
+
+type v2beta2NamespaceLister struct {
+	lister v2beta2listers.HorizontalPodAutoscalerNamespaceLister
+}
+
+func (l *v2beta2NamespaceLister) List(selector labels.Selector) ([]*v2.HorizontalPodAutoscaler, error) {
+	hpas, err := l.lister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	return convertV2beta2List(hpas)
+}
+
+func (l *v2beta2NamespaceLister) Get(name string) (*v2.HorizontalPodAutoscaler, error) {
+	hpa, err := l.lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return convertV2beta2(hpa)
+}
+
+// convertV1 converts a autoscaling/v1 hpa to autoscaling/v2, the cpu utilization target
+// becomes the only metric of the hpa.
+func convertV1(in *autoscalingv1.HorizontalPodAutoscaler) *v2.HorizontalPodAutoscaler {
+	out := &v2.HorizontalPodAutoscaler{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v2.SchemeGroupVersion.String(), Kind: "HorizontalPodAutoscaler"},
+		ObjectMeta: *in.ObjectMeta.DeepCopy(),
+		Spec: v2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: v2.CrossVersionObjectReference{
+				APIVersion: in.Spec.ScaleTargetRef.APIVersion,
+				Kind:       in.Spec.ScaleTargetRef.Kind,
+				Name:       in.Spec.ScaleTargetRef.Name,
+			},
+			MinReplicas: in.Spec.MinReplicas,
+			MaxReplicas: in.Spec.MaxReplicas,
+		},
+		Status: v2.HorizontalPodAutoscalerStatus{
+			ObservedGeneration: in.Status.ObservedGeneration,
+			LastScaleTime:      in.Status.LastScaleTime,
+			CurrentReplicas:    in.Status.CurrentReplicas,
+			DesiredReplicas:    in.Status.DesiredReplicas,
+		},
+	}
+
+	if utilization := in.Spec.TargetCPUUtilizationPercentage; utilization != nil {
+		target := *utilization
+		out.Spec.Metrics = []v2.MetricSpec{{
+			Type: v2.ResourceMetricSourceType,
+			Resource: &v2.ResourceMetricSource{
+				Name:   corev1.ResourceCPU,
+				Target: v2.MetricTarget{Type: v2.UtilizationMetricType, AverageUtilization: &target},
+			},
+		}}
+	}
+	if utilization := in.Status.CurrentCPUUtilizationPercentage; utilization != nil {
+		current := *utilization
+		out.Status.CurrentMetrics = []v2.MetricStatus{{
+			Type: v2.ResourceMetricSourceType,
+			Resource: &v2.ResourceMetricStatus{
+				Name:    corev1.ResourceCPU,
+				Current: v2.MetricValueStatus{AverageUtilization: &current},
+			},
+		}}
+	}
+	return out
+}
+
+func convertV1List(in []*autoscalingv1.HorizontalPodAutoscaler) []*v2.HorizontalPodAutoscaler {
+	out := make([]*v2.HorizontalPodAutoscaler, 0, len(in))
+	for _, hpa := range in {
+		out = append(out, convertV1(hpa))
+	}
+	return out
+}
+
+// v1Lister serves the autoscaling/v1 hpas as autoscaling/v2.
+type v1Lister struct {
+	lister autoscalingv1listers.HorizontalPodAutoscalerLister
+}
+
+func (l *v1Lister) List(selector labels.Selector) ([]*v2.HorizontalPodAutoscaler, error) {
+	hpas, err := l.lister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	return convertV1List(hpas), nil
+}
+
+func (l *v1Lister) HorizontalPodAutoscalers(namespace string) v2listers.HorizontalPodAutoscalerNamespaceLister {
+	return &v1NamespaceLister{lister: l.lister.HorizontalPodAutoscalers(namespace)}
+}
+
+type v1NamespaceLister struct {
+	lister autoscalingv1listers.HorizontalPodAutoscalerNamespaceLister
+}
+
+func (l *v1NamespaceLister) List(selector labels.Selector) ([]*v2.HorizontalPodAutoscaler, error) {
+	hpas, err := l.lister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	return convertV1List(hpas), nil
+}
+
+func (l *v1NamespaceLister) Get(name string) (*v2.HorizontalPodAutoscaler, error) {
+	hpa, err := l.lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return convertV1(hpa), nil
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	v2 "k8s.io/api/autoscaling/v2"
+	"k8s.io/api/autoscaling/v2beta2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	kubeinformers "k8s.io/client-go/informers"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConvertV2beta2ResourceMetric(t *testing.T) {
+	utilization := int32(80)
+	in := &v2beta2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: metav1.NamespaceDefault},
+		Spec: v2beta2.HorizontalPodAutoscalerSpec{
+			MaxReplicas: 10,
+			Metrics: []v2beta2.MetricSpec{
+				{
+					Type: v2beta2.ResourceMetricSourceType,
+					Resource: &v2beta2.ResourceMetricSource{
+						Name: v1.ResourceCPU,
+						Target: v2beta2.MetricTarget{
+							Type:               v2beta2.UtilizationMetricType,
+							AverageUtilization: &utilization,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	out, err := convertV2beta2(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := resourceUtilizationMetric(v1.ResourceCPU, 80)
+	if len(out.Spec.Metrics) != 1 || !reflect.DeepEqual(out.Spec.Metrics[0], expected) {
+		t.Errorf("expected metrics %v, got %v", []v2.MetricSpec{expected}, out.Spec.Metrics)
+	}
+	if out.Name != in.Name || out.Namespace != in.Namespace || out.Spec.MaxReplicas != 10 {
+		t.Errorf("unexpected converted object %v", out)
+	}
+}
+
+func TestConvertV1(t *testing.T) {
+	minReplicas, target, current := int32(2), int32(70), int32(55)
+	in := &autoscalingv1.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: metav1.NamespaceDefault, Annotations: map[string]string{"owner": "team"}},
+		Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef:                 autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "test"},
+			MinReplicas:                    &minReplicas,
+			MaxReplicas:                    10,
+			TargetCPUUtilizationPercentage: &target,
+		},
+		Status: autoscalingv1.HorizontalPodAutoscalerStatus{
+			CurrentReplicas:                 3,
+			DesiredReplicas:                 4,
+			CurrentCPUUtilizationPercentage: &current,
+		},
+	}
+
+	out := convertV1(in)
+
+	expected := resourceUtilizationMetric(v1.ResourceCPU, 70)
+	if len(out.Spec.Metrics) != 1 || !reflect.DeepEqual(out.Spec.Metrics[0], expected) {
+		t.Errorf("expected metrics %v, got %v", []v2.MetricSpec{expected}, out.Spec.Metrics)
+	}
+	if out.Name != in.Name || out.Namespace != in.Namespace || out.Annotations["owner"] != "team" {
+		t.Errorf("expected the metadata to be kept, got %v", out.ObjectMeta)
+	}
+	if *out.Spec.MinReplicas != 2 || out.Spec.MaxReplicas != 10 || out.Spec.ScaleTargetRef.Name != "test" {
+		t.Errorf("unexpected converted spec %v", out.Spec)
+	}
+
+	m := newTestController(WithStatusAnnotations()).annotations(out)
+	for key, value := range map[string]string{"cpuTargetUtilization": "70", "currentCpuUtilization": "55", "currentReplicas": "3"} {
+		if m[key] != value {
+			t.Errorf("expected %s=%s, got %q", key, value, m[key])
+		}
+	}
+
+	in.Spec.TargetCPUUtilizationPercentage = nil
+	if out := convertV1(in); len(out.Spec.Metrics) != 0 {
+		t.Errorf("expected no metrics without a cpu target, got %v", out.Spec.Metrics)
+	}
+}
+
+func TestNewHPAControllerWithDiscovery(t *testing.T) {
+	tests := []struct {
+		name     string
+		served   []string
+		expected string
+		wantErr  bool
+	}{
+		{name: "v2", served: []string{"autoscaling/v2", "autoscaling/v2beta2"}, expected: "autoscaling/v2"},
+		{name: "v2beta2", served: []string{"autoscaling/v2beta2"}, expected: "autoscaling/v2beta2"},
+		{name: "v1", served: []string{"autoscaling/v1"}, expected: "autoscaling/v1"},
+		{name: "none", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := k8sfake.NewSimpleClientset()
+			for _, groupVersion := range test.served {
+				client.Discovery().(*fakediscovery.FakeDiscovery).Resources = append(client.Discovery().(*fakediscovery.FakeDiscovery).Resources, &metav1.APIResourceList{
+					GroupVersion: groupVersion,
+					APIResources: []metav1.APIResource{{Name: "horizontalpodautoscalers"}},
+				})
+			}
+
+			v, err := NewHPAControllerWithDiscovery(kubeinformers.NewSharedInformerFactory(client, 0), client)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := v.groupVersion.String(); got != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSyncV1HPA(t *testing.T) {
+	target := int32(70)
+	hpa := &autoscalingv1.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: metav1.NamespaceDefault},
+		Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef:                 autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "test"},
+			MaxReplicas:                    10,
+			TargetCPUUtilizationPercentage: &target,
+		},
+	}
+	client := k8sfake.NewSimpleClientset(hpa)
+	client.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: "autoscaling/v1",
+		APIResources: []metav1.APIResource{{Name: "horizontalpodautoscalers"}},
+	}}
+	informers := kubeinformers.NewSharedInformerFactory(client, 0)
+	v, err := NewHPAControllerWithDiscovery(informers, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := informers.Autoscaling().V1().HorizontalPodAutoscalers().Informer().GetIndexer().Add(hpa); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.syncHPA(context.Background(), "default/test"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.AutoscalingV1().HorizontalPodAutoscalers(hpa.Namespace).Get(context.Background(), hpa.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Annotations["cpuTargetUtilization"] != "70" {
+		t.Errorf("expected the v1 hpa to be annotated, got %v", got.Annotations)
+	}
+}
@@ -2,125 +2,705 @@ package hpa
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	v2 "k8s.io/api/autoscaling/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	v2informers "k8s.io/client-go/informers/autoscaling/v2"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	v2listers "k8s.io/client-go/listers/autoscaling/v2"
+	"k8s.io/client-go/scale"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
+	metricsclientset "k8s.io/metrics/pkg/client/clientset/versioned"
+	"k8s.io/utils/clock"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
 const (
-	// maxRetries is the number of times a service will be retried before it is dropped out of the queue.
+	// defaultMaxRetries is the number of times a hpa will be retried before it is dropped out of the queue.
 	// With the current rate-limiter in use (5ms*2^(maxRetries-1)) the following numbers represent the
 	// sequence of delays between successive queuings of a service.
 	//
 	// 5ms, 10ms, 20ms, 40ms, 80ms, 160ms, 320ms, 640ms, 1.3s, 2.6s, 5.1s, 10.2s, 20.4s, 41s, 82s
-	maxRetries = 15
+	defaultMaxRetries = 15
+
+	// defaultWorkers is the number of workers used when none is configured.
+	defaultWorkers = 5
+
+	// defaultMinCPUTarget and defaultMaxCPUTarget bound the recommended cpu utilization targets.
+	defaultMinCPUTarget = 10
+	defaultMaxCPUTarget = 95
+
+	// conflictRetries is the number of times a conflicting patch is retried inline with the live hpa.
+	conflictRetries = 2
+
+	// defaultShutdownTimeout is the time the queue is drained on shutdown before giving up.
+	defaultShutdownTimeout = 30 * time.Second
+
+	controllerName = "hpa-controller"
+
+	// kedaGroup is the api group of the KEDA ScaledObjects generating hpas
+	kedaGroup = "keda.sh"
+
+	// pausedAnnotation stops the controller from reconciling a hpa when set to "true"
+	pausedAnnotation = "autoscaling.kubesphere.io/paused"
+	// manageAnnotation opts a hpa out of the controller when set to "false",
+	// and in when set to "true" in the opt-in mode
+	manageAnnotation = "autoscaling.kubesphere.io/manage"
+
+	// annotatedMetrics is used as part of the Event 'reason' when the annotations of a hpa are updated
+	annotatedMetrics = "AnnotatedMetrics"
+	// failedAnnotateMetrics is used as part of the Event 'reason' when the annotations of a hpa failed to update
+	failedAnnotateMetrics = "FailedAnnotateMetrics"
+	// noMetricsConfigured is used as part of the Event 'reason' when a hpa has no metrics
+	noMetricsConfigured = "NoMetricsConfigured"
+	// targetNotFound is used as part of the Event 'reason' when the scale target of a hpa doesn't exist
+	targetNotFound = "TargetNotFound"
+	// scalingThrash is used as part of the Event 'reason' when a hpa scales too frequently
+	scalingThrash = "ScalingThrash"
+	// targetOutOfRange is used as part of the Event 'reason' when a target of a hpa is outside the recommended bounds
+	targetOutOfRange = "TargetOutOfRange"
 )
 
+// Interface is implemented by the HPAController, host applications may depend on it
+// to substitute the controller in their tests.
+type Interface interface {
+	// Start runs the controller until ctx is canceled, with leader election when configured.
+	Start(ctx context.Context) error
+	// Run runs workers syncing the hpas until stopCh is closed.
+	Run(workers int, stopCh <-chan struct{}) error
+	// Stats returns a snapshot of the queue and the syncs of the controller.
+	Stats() ControllerStats
+	// ResyncAll enqueues all the hpas of the cache.
+	ResyncAll() error
+}
+
+var _ Interface = (*HPAController)(nil)
+
 type HPAController struct {
 	client clientset.Interface
 
-	hpaLister v2listers.HorizontalPodAutoscalerLister
-	hpaSynced cache.InformerSynced
+	// groupVersion is the autoscaling API version the hpas are read and patched with.
+	groupVersion schema.GroupVersion
+
+	hpaLister  v2listers.HorizontalPodAutoscalerLister
+	hpaIndexer cache.Indexer
+	hpaSynced  cache.InformerSynced
 
 	queue workqueue.RateLimitingInterface
+	// rateLimiter computes the requeue delays of the failed hpas.
+	rateLimiter workqueue.RateLimiter
+	// queueName names the queue in the workqueue metrics, defaults to "hpa".
+	queueName string
+
+	// eventBroadcaster sends the events of the recorder while the controller is running.
+	eventBroadcaster record.EventBroadcaster
+	recorder         record.EventRecorder
+	// eventCorrelatorOptions tunes the aggregation and the rate limiting of the events, the zero values use the client-go defaults.
+	eventCorrelatorOptions record.CorrelatorOptions
+
+	stats *controllerStats
+
+	// writtenVersions are the resourceVersions of our own patches,
+	// the update events carrying them are not enqueued again.
+	writtenVersions *versionCache
 
 	workerLoopPeriod time.Duration
+
+	// Workers is the number of workers started by Start, defaults to 5.
+	Workers int
+
+	// fixedDelays requeue the hpas failing with the matched errors after a fixed delay instead of the backoff.
+	fixedDelays []fixedDelayRequeue
+	// fixedDelayAttempts counts the fixed delay requeues, they don't count towards the NumRequeues of the queue.
+	fixedDelayAttempts *attemptCounter
+
+	// maxRetries is the number of times a hpa will be retried before it is dropped out of the queue.
+	maxRetries int
+
+	// shutdownTimeout bounds the time spent draining the queue on shutdown.
+	shutdownTimeout time.Duration
+
+	// reconcileTimeout bounds the time spent syncing a single hpa, zero means no timeout.
+	reconcileTimeout time.Duration
+
+	// resyncPeriod is the period all hpas are re-enqueued, zero disables it.
+	resyncPeriod time.Duration
+
+	// clock reads the time of the resync, the thrash detection and the sync durations.
+	clock clock.WithTicker
+
+	tracer trace.Tracer
+
+	// keyTemplate renders the keys of the metric target annotations when set.
+	keyTemplate *template.Template
+
+	// disabledResources are the resources whose metrics aren't annotated.
+	disabledResources []v1.ResourceName
+
+	// annotationPrefix is prepended to all managed annotation keys.
+	annotationPrefix string
+
+	// enricher returns extra annotations written along with the managed ones.
+	enricher func(*autoscalingv2.HorizontalPodAutoscaler) map[string]string
+
+	// minCPUTarget and maxCPUTarget bound the recommended cpu utilization targets.
+	minCPUTarget int32
+	maxCPUTarget int32
+
+	// percentSuffix renders the utilization targets with a % suffix.
+	percentSuffix bool
+
+	// defaults overrides the percentSuffix and the disabledResources with the settings of a ConfigMap when set.
+	defaults *configMapDefaults
+
+	// namespace restricts the controller to a single namespace, empty means all namespaces.
+	namespace string
+	// namespaces restricts the controller to a set of namespaces, empty means all namespaces.
+	namespaces sets.String
+
+	// selector restricts the controller to the hpas matching it, nil means all hpas.
+	selector labels.Selector
+
+	// errs are the errors of invalid options, they are returned by Run.
+	errs []error
+
+	// leaderElection is nil when leader election is disabled.
+	leaderElection *leaderElectionConfig
+
+	// synced is set once the caches are synced in Run.
+	synced atomic.Bool
+	// running is set while the workers are running.
+	running atomic.Bool
+
+	// targetValidation enables checking the scale targets exist, which costs an API call per sync.
+	targetValidation bool
+
+	// dryRun computes the patches but never applies them.
+	dryRun bool
+
+	// metricsClient reads the current usage of the scale targets when set.
+	metricsClient metricsclientset.Interface
+
+	// optIn only syncs the hpas opted in with the manage annotation.
+	optIn bool
+
+	// scales resolves the scale targets of the kinds without typed clients through their scale subresource,
+	// restMapper maps their kinds to resources.
+	scales     scale.ScalesGetter
+	restMapper meta.RESTMapper
+
+	// changeDetector decides whether the desired annotations are written, on top of the key-by-key comparison.
+	changeDetector func(existing, desired map[string]string) bool
+
+	// cleanupOnStop removes the managed annotations of all the hpas on shutdown.
+	cleanupOnStop bool
+
+	// annotateCPURequest annotates the cpu request of the pods of the scale targets.
+	annotateCPURequest bool
+
+	// syncInterval delays the syncs of the hpas synced within the minimum sync interval when set.
+	syncInterval *syncInterval
+
+	// thrash detects the hpas scaling too frequently when thrash detection is enabled.
+	thrash *thrashDetector
+
+	// maxInflightWrites caps the concurrent patches, defaults to the number of workers.
+	maxInflightWrites int
+	writes            chan struct{}
+
+	// batcher coalesces the patches when batching is enabled.
+	batcher *patchBatcher
+
+	// deadLetterHandler is called with the hpas dropped out of the queue after maxRetries.
+	deadLetterHandler func(key string, err error)
+
+	// statusAnnotations annotates the replica counts and the current metric values, see WithStatusAnnotations.
+	statusAnnotations bool
+
+	// metricTypes are the source types of the annotated metrics, see SetEnabledMetricTypes.
+	metricTypes enabledMetricTypes
+
+	// excludedKeys are the annotation keys never written nor pruned by the controller.
+	excludedKeys sets.String
+
+	// reconcileTimestamp records the time of the last sync which changed the annotations.
+	reconcileTimestamp bool
+
+	// fieldManager enables server-side apply of the annotations with this field manager when set.
+	fieldManager string
+
+	// skippedOwners are the kinds of the controllers owning hpas that are left untouched.
+	skippedOwners []schema.GroupKind
+}
+
+func NewHPAController(hpaInformer v2informers.HorizontalPodAutoscalerInformer, client clientset.Interface, opts ...Option) *HPAController {
+	return newHPAController(hpaInformer.Informer(), hpaInformer.Lister(), autoscalingv2.SchemeGroupVersion, client, opts...)
 }
 
-func NewHPAController(hpaInformer v2informers.HorizontalPodAutoscalerInformer, client clientset.Interface) *HPAController {
+// newHPAController creates a HPAController watching the hpas of groupVersion served by informer,
+// lister must convert them to the autoscaling/v2 types.
+func newHPAController(informer cache.SharedIndexInformer, lister v2listers.HorizontalPodAutoscalerLister, groupVersion schema.GroupVersion,
+	client clientset.Interface, opts ...Option) *HPAController {
 	v := &HPAController{
-		client:           client,
-		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "hpa"),
-		workerLoopPeriod: time.Second,
+		client:             client,
+		groupVersion:       groupVersion,
+		writtenVersions:    newVersionCache(),
+		fixedDelayAttempts: newAttemptCounter(),
+		stats:              newControllerStats(),
+		rateLimiter:        workqueue.DefaultControllerRateLimiter(),
+		queueName:          "hpa",
+		workerLoopPeriod:   time.Second,
+		Workers:            defaultWorkers,
+		maxRetries:         defaultMaxRetries,
+		shutdownTimeout:    defaultShutdownTimeout,
+		minCPUTarget:       defaultMinCPUTarget,
+		maxCPUTarget:       defaultMaxCPUTarget,
+		clock:              clock.RealClock{},
+		tracer:             trace.NewNoopTracerProvider().Tracer(controllerName),
+		skippedOwners:      []schema.GroupKind{{Group: kedaGroup, Kind: "ScaledObject"}},
 	}
 
-	v.hpaLister = hpaInformer.Lister()
-	v.hpaSynced = hpaInformer.Informer().HasSynced
+	for _, opt := range opts {
+		opt(v)
+	}
 
-	hpaInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: v.enqueueHPA,
-		UpdateFunc: func(old, cur interface{}) {
-			v.enqueueHPA(cur)
-		},
+	// the correlator of the broadcaster deduplicates the identical events into a count, aggregates
+	// the similar ones and rate limits the events per hpa, so a churning hpa doesn't flood the events
+	v.eventBroadcaster = record.NewBroadcasterWithCorrelatorOptions(v.eventCorrelatorOptions)
+	v.recorder = v.eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: controllerName})
+	if v.Workers <= 0 {
+		v.Workers = defaultWorkers
+	}
+	if v.maxInflightWrites <= 0 {
+		v.maxInflightWrites = v.Workers
+	}
+	v.writes = make(chan struct{}, v.maxInflightWrites)
+	if v.defaults != nil {
+		v.watchDefaults()
+	}
+	if v.keyTemplate != nil {
+		// the prefix may be set by an option after the template
+		if err := validateKeyTemplate(v.keyTemplate, v.annotationPrefix); err != nil {
+			v.errs = append(v.errs, err)
+			v.keyTemplate = nil
+		}
+	}
+	// the delayed requeues run on the clock of the controller as well
+	v.queue = workqueue.NewRateLimitingQueueWithDelayingInterface(workqueue.NewDelayingQueueWithCustomClock(v.clock, v.queueName), v.rateLimiter)
+	for _, err := range v.errs {
+		klog.ErrorS(err, "Invalid hpa controller option")
+	}
+
+	v.hpaLister = lister
+	v.hpaSynced = informer.HasSynced
+
+	if err := informer.AddIndexers(cache.Indexers{scaleTargetIndex: indexByScaleTarget}); err != nil {
+		klog.ErrorS(err, "Failed to add the scale target index")
+	}
+	v.hpaIndexer = informer.GetIndexer()
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    v.enqueueHPA,
+		UpdateFunc: v.updateHPA,
+		DeleteFunc: v.deleteHPA,
 	})
 
 	return v
 }
 
 func (v *HPAController) Start(ctx context.Context) error {
-	return v.Run(5, ctx.Done())
+	if v.leaderElection != nil {
+		return v.runWithLeaderElection(ctx)
+	}
+	return v.RunWithContext(ctx, v.Workers)
 }
 
+// Run is kept for compatibility, see RunWithContext.
 func (v *HPAController) Run(workers int, stopCh <-chan struct{}) error {
+	ctx, cancel := wait.ContextForChannel(stopCh)
+	defer cancel()
+	return v.RunWithContext(ctx, workers)
+}
+
+// RunWithContext starts workers syncing the hpas until ctx is canceled,
+// the queued hpas are drained before it returns.
+func (v *HPAController) RunWithContext(ctx context.Context, workers int) error {
 	defer utilruntime.HandleCrash()
 	defer v.queue.ShutDown()
 
-	klog.Info("starting hpa controller")
-	defer klog.Info("shutting down hpa controller")
+	if len(v.errs) != 0 {
+		return utilerrors.NewAggregate(v.errs)
+	}
+
+	// the events are sent until the queue is drained and the annotations are cleaned up
+	v.eventBroadcaster.StartStructuredLogging(0)
+	v.eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: v.client.CoreV1().Events("")})
+	defer v.eventBroadcaster.Shutdown()
+
+	klog.InfoS("Starting hpa controller")
+	defer klog.InfoS("Shutting down hpa controller")
 
-	if !cache.WaitForCacheSync(stopCh, v.hpaSynced) {
+	synced := []cache.InformerSynced{v.hpaSynced}
+	if v.defaults != nil {
+		synced = append(synced, v.defaults.informer.Informer().HasSynced)
+	}
+	syncStart := v.clock.Now()
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
+	syncDuration := v.clock.Since(syncStart)
+	cacheSyncDuration.Set(syncDuration.Seconds())
+	klog.InfoS("Synced the hpa caches", "duration", syncDuration)
+	v.synced.Store(true)
+
+	// runs once the queue is drained, so the flushed annotations are removed as well
+	if v.cleanupOnStop {
+		defer v.cleanup()
+	}
+	if v.resyncPeriod > 0 {
+		go v.resync(ctx.Done())
+	}
+	if v.batcher != nil {
+		go v.runBatcher(ctx.Done())
+	}
 
+	// the workers outlive ctx to drain the queue, workerCtx is canceled once draining is done or timed out
+	workerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	v.running.Store(true)
+	defer v.running.Store(false)
+
+	var wg sync.WaitGroup
 	for i := 0; i < workers; i++ {
-		go wait.Until(v.worker, v.workerLoopPeriod, stopCh)
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			v.until(withWorker(workerCtx, worker), v.worker)
+		}(i)
 	}
 
-	<-stopCh
+	<-ctx.Done()
+	if v.batcher != nil {
+		v.flushFinalBatch()
+	}
+	v.drain(cancel, &wg)
+	return nil
+}
+
+// Healthz reports an error unless the workers are running.
+func (v *HPAController) Healthz(_ *http.Request) error {
+	if !v.running.Load() {
+		return fmt.Errorf("hpa controller workers are not running")
+	}
+	return nil
+}
+
+// Readyz reports an error until the caches are synced.
+func (v *HPAController) Readyz(_ *http.Request) error {
+	if !v.synced.Load() {
+		return fmt.Errorf("hpa controller caches are not synced")
+	}
+	return nil
+}
+
+// drain stops accepting new items and waits for the workers to process the queued ones,
+// the in-flight syncs are canceled after shutdownTimeout.
+func (v *HPAController) drain(cancel context.CancelFunc, wg *sync.WaitGroup) {
+	drained := make(chan struct{})
+	go func() {
+		v.queue.ShutDownWithDrain()
+		cancel()
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-v.clock.After(v.shutdownTimeout):
+		klog.InfoS("Timed out draining the hpa queue", "timeout", v.shutdownTimeout)
+		v.queue.ShutDown()
+		cancel()
+	}
+}
+
+// resync re-enqueues all the hpas every resyncPeriod, so the annotations changed by others are corrected.
+// The informer factory may be created without resync, hence the hpas are listed here.
+func (v *HPAController) resync(stopCh <-chan struct{}) {
+	ticker := v.clock.NewTicker(v.resyncPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C():
+			if err := v.ResyncAll(); err != nil {
+				utilruntime.HandleError(err)
+			}
+		}
+	}
+}
+
+// ResyncAll enqueues all the hpas of the cache, e.g. to repair drifted annotations
+// from a signal handler or an admin endpoint without restarting the controller.
+func (v *HPAController) ResyncAll() error {
+	hpas, err := v.hpaLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("couldn't list hpas: %v", err)
+	}
+	for _, hpa := range hpas {
+		v.enqueueHPA(hpa)
+	}
 	return nil
 }
 
 func (v *HPAController) enqueueHPA(obj interface{}) {
+	// the hpa may have been deleted while the watch was disconnected
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("couldn't get object from %+v: %v", obj, err))
+		return
+	}
 	key, err := cache.MetaNamespaceKeyFunc(obj)
 	if err != nil {
 		utilruntime.HandleError(fmt.Errorf("couldn't get key for object %+v: %v", obj, err))
 		return
 	}
+	if !v.managed(accessor) {
+		return
+	}
+	v.add(key)
+	queueDepth.Set(float64(v.queue.Len()))
+}
+
+// add enqueues the key, delayed until the minimum sync interval of the hpa has passed,
+// the events received in the meantime are coalesced into a single sync.
+func (v *HPAController) add(key string) {
+	if v.syncInterval != nil {
+		if delay := v.syncInterval.delay(key, v.clock.Now()); delay > 0 {
+			v.queue.AddAfter(key, delay)
+			return
+		}
+	}
 	v.queue.Add(key)
 }
 
-func (v *HPAController) worker() {
-	for v.processNextWorkItem() {
+// namespaceManaged returns true if hpas in the namespace should be reconciled by this controller.
+func (v *HPAController) namespaceManaged(namespace string) bool {
+	if v.namespace != "" && v.namespace != namespace {
+		return false
+	}
+	return v.namespaces.Len() == 0 || v.namespaces.Has(namespace)
+}
+
+// managed returns true if the hpa should be reconciled by this controller.
+func (v *HPAController) managed(obj metav1.Object) bool {
+	if !v.namespaceManaged(obj.GetNamespace()) {
+		return false
+	}
+	return v.selector == nil || v.selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// optedIn returns false if the hpa is opted out with the manage annotation, or if it isn't
+// opted in with it when the controller runs in the opt-in mode.
+func (v *HPAController) optedIn(obj metav1.Object) bool {
+	switch obj.GetAnnotations()[manageAnnotation] {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return !v.optIn
+}
+
+// ignored returns true if the controller doesn't sync the hpa, because it's out of scope, paused,
+// opted out or owned by a skipped owner.
+func (v *HPAController) ignored(hpa *autoscalingv2.HorizontalPodAutoscaler) bool {
+	return !v.managed(hpa) || hpa.Annotations[pausedAnnotation] == "true" || !v.optedIn(hpa) || v.ownedBySkippedOwner(hpa)
+}
+
+// ownedBySkippedOwner returns true if the hpa is controlled by one of the skipped owner kinds.
+func (v *HPAController) ownedBySkippedOwner(obj metav1.Object) bool {
+	owner := metav1.GetControllerOfNoCopy(obj)
+	if owner == nil {
+		return false
+	}
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return false
+	}
+	for _, gk := range v.skippedOwners {
+		if gk.Group == gv.Group && gk.Kind == owner.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *HPAController) updateHPA(old, cur interface{}) {
+	// skip the update events caused by our own patches
+	if key, err := cache.MetaNamespaceKeyFunc(cur); err == nil {
+		if accessor, err := meta.Accessor(cur); err == nil && v.writtenVersions.consume(key, accessor.GetResourceVersion()) {
+			return
+		}
+	}
+	v.enqueueHPA(cur)
+}
+
+func (v *HPAController) deleteHPA(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+		v.writtenVersions.delete(key)
+		if v.syncInterval != nil {
+			v.syncInterval.forget(key)
+		}
+		if v.thrash != nil {
+			v.thrash.forget(key)
+		}
+	}
+	v.enqueueHPA(obj)
+}
+
+// until runs f until ctx is canceled, restarting it workerLoopPeriod after it returned
+// as measured by the clock of the controller.
+func (v *HPAController) until(ctx context.Context, f func(context.Context)) {
+	backoff := wait.NewJitteredBackoffManager(v.workerLoopPeriod, 0, v.clock)
+	wait.BackoffUntil(func() { f(ctx) }, backoff, true, ctx.Done())
+}
+
+func (v *HPAController) worker(ctx context.Context) {
+	for v.processNextWorkItem(ctx) {
 
 	}
 }
 
-func (v *HPAController) processNextWorkItem() bool {
+func (v *HPAController) processNextWorkItem(ctx context.Context) bool {
 	eKey, quit := v.queue.Get()
 	if quit {
 		return false
 	}
 
 	defer v.queue.Done(eKey)
+	queueDepth.Set(float64(v.queue.Len()))
 
-	err := v.syncHPA(eKey.(string))
-	v.handleErr(err, eKey)
+	if v.syncInterval != nil {
+		// the key may have been added while it was being synced
+		now := v.clock.Now()
+		if delay := v.syncInterval.delay(eKey.(string), now); delay > 0 {
+			v.queue.AddAfter(eKey, delay)
+			return true
+		}
+		v.syncInterval.observe(eKey.(string), now)
+	}
+
+	err := v.syncWithRecovery(ctx, eKey.(string))
+	v.syncDone(eKey.(string), err)
 
 	return true
 }
 
+// syncDone records the result of the sync of the hpa, the result of a batched sync is
+// recorded once the batch is flushed.
+func (v *HPAController) syncDone(key string, err error) {
+	if err == errPending {
+		return
+	}
+	v.handleErr(err, key)
+	v.stats.observe(key, err, v.queue.NumRequeues(key))
+}
+
+// workerKey is the context key of the index of the worker syncing a hpa.
+type workerKey struct{}
+
+func withWorker(ctx context.Context, worker int) context.Context {
+	return context.WithValue(ctx, workerKey{}, worker)
+}
+
+// syncWithRecovery syncs the hpa and turns a panic into an error, so the hpa is requeued
+// instead of crashing the controller or being silently dropped.
+func (v *HPAController) syncWithRecovery(ctx context.Context, key string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			worker, _ := ctx.Value(workerKey{}).(int)
+			err = fmt.Errorf("panic syncing hpa: %v", r)
+			klog.ErrorS(err, "Observed a panic syncing hpa", "worker", worker, "key", key, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	return v.syncHPA(ctx, key)
+}
+
 // main function of the reconcile for hpa
-func (v *HPAController) syncHPA(key string) error {
-	startTime := time.Now()
+func (v *HPAController) syncHPA(ctx context.Context, key string) (err error) {
+	if v.reconcileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.reconcileTimeout)
+		defer cancel()
+	}
+
+	ctx, span := v.tracer.Start(ctx, "hpa.syncHPA")
+	updated := false
 	defer func() {
-		klog.V(4).Info("Finished syncing hps.", "key", key, "duration", time.Since(startTime))
+		err = classifyError(err)
+		span.SetAttributes(attribute.Bool("updated", updated))
+		if err != nil && err != errPending {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	startTime := v.clock.Now()
+	defer func() {
+		duration := v.clock.Since(startTime)
+		reconcileDuration.Observe(duration.Seconds())
+		if err == nil {
+			lastSuccessTimestamp.Set(float64(v.clock.Now().UnixNano()) / float64(time.Second))
+		}
+		klog.V(4).InfoS("Finished syncing hpa", "key", key, "duration", duration)
 	}()
 
 	namespace, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
 		return err
 	}
+	span.SetAttributes(attribute.String("namespace", namespace), attribute.String("name", name))
+
+	if !v.namespaceManaged(namespace) {
+		klog.V(4).InfoS("Skip syncing hpa out of the managed namespace", "key", key)
+		return nil
+	}
 
 	hpa, err := v.hpaLister.HorizontalPodAutoscalers(namespace).Get(name)
 	if err != nil {
@@ -128,66 +708,377 @@ func (v *HPAController) syncHPA(key string) error {
 		if errors.IsNotFound(err) {
 			return nil
 		}
-		klog.Error(err, "get hpa failed", "namespace", namespace, "name", name)
+		klog.ErrorS(err, "Failed to get hpa", "namespace", namespace, "name", name)
+		return err
+	}
+
+	if !v.managed(hpa) {
+		klog.V(4).InfoS("Skip syncing hpa not matching the selector", "key", key)
+		return nil
+	}
+
+	if hpa.Annotations[pausedAnnotation] == "true" {
+		klog.V(4).InfoS("Skip syncing paused hpa", "key", key)
+		return nil
+	}
+
+	if !v.optedIn(hpa) {
+		klog.V(4).InfoS("Skip syncing hpa opted out of the controller", "key", key)
+		return nil
+	}
+
+	if v.ownedBySkippedOwner(hpa) {
+		klog.V(4).InfoS("Skip syncing hpa managed by another operator", "key", key)
+		return nil
+	}
+
+	annotationsMaps, err := v.desiredAnnotations(ctx, key, hpa)
+	if err != nil {
 		return err
 	}
 
-	hpaCopyed := hpa.DeepCopy()
+	// the batcher computes the patch against the latest state when it's flushed
+	if v.batcher != nil && !v.dryRun && v.batcher.add(key, annotationsMaps) {
+		return errPending
+	}
 
-	annotationsMaps := v.annotations(hpaCopyed)
-	if len(annotationsMaps) != 0 {
-		if hpaCopyed.Annotations == nil {
-			hpaCopyed.Annotations = make(map[string]string)
+	updated, err = v.applyAnnotations(ctx, key, hpa, annotationsMaps)
+	// the lister may still serve the stale hpa, retry with the live one before requeueing
+	for i := 0; i < conflictRetries && errors.IsConflict(err); i++ {
+		klog.V(2).InfoS("Conflict patching hpa, retrying with the live hpa", "key", key, "attempt", i+1)
+		hpa, err = v.getHPA(ctx, namespace, name)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		// the desired annotations are computed again from the live hpa, not to write stale values over it
+		if v.ignored(hpa) {
+			return nil
 		}
+		annotationsMaps, err = v.desiredAnnotations(ctx, key, hpa)
+		if err != nil {
+			return err
+		}
+		updated, err = v.applyAnnotations(ctx, key, hpa, annotationsMaps)
+	}
+	return err
+}
+
+// desiredAnnotations validates the hpa and returns the annotations it should carry, recording the events
+// of the problems found along the way.
+func (v *HPAController) desiredAnnotations(ctx context.Context, key string, hpa *autoscalingv2.HorizontalPodAutoscaler) (map[string]string, error) {
+	if err := validateHPA(hpa); err != nil {
+		return nil, invalidSpec(err)
+	}
 
-		for key, value := range annotationsMaps {
-			hpaCopyed.Annotations[key] = value
+	if len(hpa.Spec.Metrics) == 0 {
+		klog.V(2).InfoS("No metrics configured for hpa", "key", key)
+		v.eventf(hpa, v1.EventTypeWarning, noMetricsConfigured, "No metrics are configured, the hpa won't scale on any metric")
+	}
+
+	annotationsMaps := v.annotations(hpa)
+
+	if v.targetValidation {
+		exists, err := v.targetExists(ctx, hpa)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			key := v.annotationPrefix + "targetMissing"
+			if hpa.Annotations[key] != "true" {
+				v.eventf(hpa, v1.EventTypeWarning, targetNotFound, "Scale target %s doesn't exist", formatScaleTargetRef(hpa.Spec.ScaleTargetRef))
+			}
+			annotationsMaps[key] = "true"
+		}
+	}
+
+	if utilization, ok := v.cpuTargetOutOfRange(hpa); ok {
+		key := v.annotationPrefix + "targetOutOfRange"
+		if hpa.Annotations[key] != "cpu" {
+			v.eventf(hpa, v1.EventTypeWarning, targetOutOfRange, "CPU utilization target %d%% is outside the recommended range %d%%-%d%%",
+				utilization, v.minCPUTarget, v.maxCPUTarget)
+		}
+		annotationsMaps[key] = "cpu"
+	}
+
+	if v.metricsClient != nil {
+		usage, err := v.usageAnnotations(ctx, hpa)
+		if err != nil {
+			// the metrics API may be unavailable, keep the last known usage
+			klog.V(4).InfoS("Failed to read the current usage of hpa", "key", key, "err", err)
+			usage = make(map[string]string)
+			for _, name := range usageAnnotationKeys {
+				if value, ok := hpa.Annotations[v.annotationPrefix+name]; ok {
+					usage[name] = value
+				}
+			}
+		}
+		for name, value := range usage {
+			annotationsMaps[v.annotationPrefix+name] = value
 		}
 	}
 
-	_, err = v.client.AutoscalingV2().HorizontalPodAutoscalers(hpaCopyed.Namespace).Update(context.Background(), hpaCopyed, metav1.UpdateOptions{})
+	if v.annotateCPURequest {
+		requestKey := v.annotationPrefix + "cpuRequest"
+		request, err := v.cpuRequest(ctx, hpa)
+		switch {
+		case err == errUnknownTargetKind:
+		case err != nil:
+			// keep the last known request, the scale target may be missing
+			klog.V(4).InfoS("Failed to read the cpu request of hpa", "key", key, "err", err)
+			if value, ok := hpa.Annotations[requestKey]; ok {
+				annotationsMaps[requestKey] = value
+			}
+		case request != "":
+			annotationsMaps[requestKey] = request
+		}
+	}
+
+	if v.thrash != nil && hpa.Status.LastScaleTime != nil && v.thrash.observe(key, hpa.Status.LastScaleTime.Time, v.clock.Now()) {
+		key := v.annotationPrefix + "scalingThrash"
+		if hpa.Annotations[key] != "true" {
+			v.eventf(hpa, v1.EventTypeWarning, scalingThrash, "Scaled more than %d times within %v", v.thrash.maxScales, v.thrash.window)
+		}
+		annotationsMaps[key] = "true"
+	}
+
+	return annotationsMaps, nil
+}
+
+// eventf records an event on the hpa, in dry run it's only logged since recording it writes to the API too.
+func (v *HPAController) eventf(hpa *autoscalingv2.HorizontalPodAutoscaler, eventType, reason, messageFmt string, args ...interface{}) {
+	if v.dryRun {
+		klog.V(2).InfoS("Dry run, skip recording event", "hpa", klog.KObj(hpa), "type", eventType, "reason", reason, "message", fmt.Sprintf(messageFmt, args...))
+		return
+	}
+	v.recorder.Eventf(hpa, eventType, reason, messageFmt, args...)
+}
+
+// applyAnnotations patches the hpa with the desired annotations, it returns false if nothing was patched.
+func (v *HPAController) applyAnnotations(ctx context.Context, key string, hpa *autoscalingv2.HorizontalPodAutoscaler, desired map[string]string) (bool, error) {
+	for key := range desired {
+		if v.excludedAnnotation(key) {
+			delete(desired, key)
+		}
+	}
+
+	if v.changeDetector != nil && !v.changeDetector(hpa.Annotations, desired) {
+		return false, nil
+	}
+
+	timestampKey := v.annotationPrefix + lastReconcileTimeAnnotation
+	if v.reconcileTimestamp {
+		// keep the last timestamp, so it alone never causes a patch
+		if timestamp, ok := hpa.Annotations[timestampKey]; ok {
+			desired[timestampKey] = timestamp
+		} else {
+			desired[timestampKey] = ""
+		}
+	}
+
+	patch := v.annotationsPatch(hpa.Annotations, desired)
+	// nothing changed, skip the patch to avoid triggering another reconcile
+	if len(patch) == 0 {
+		return false, nil
+	}
+
+	if v.reconcileTimestamp {
+		timestamp := v.clock.Now().UTC().Format(time.RFC3339)
+		desired[timestampKey] = timestamp
+		patch[timestampKey] = timestamp
+	}
+
+	pt, data, opts, err := v.patchRequest(hpa, desired, patch)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	if v.dryRun {
+		klog.InfoS("Dry run, skip patching hpa", "key", key, "annotations", desired, "patch", string(data))
+		return false, nil
+	}
+
+	select {
+	case v.writes <- struct{}{}:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	// release the slot even if the patch panics, the panics of the syncs are recovered
+	defer func() { <-v.writes }()
+	patched, err := v.patchHPA(ctx, hpa.Namespace, hpa.Name, pt, data, opts)
+	if err != nil {
+		v.recorder.Eventf(hpa, v1.EventTypeWarning, failedAnnotateMetrics, "Failed to update metrics annotations: %v", err)
+		return false, err
+	}
+	v.writtenVersions.set(key, patched.GetResourceVersion())
+	observeAnnotationOps(hpa.Annotations, patch)
+
+	// the status annotations change too often for an event each time
+	if !v.statusOnlyPatch(patch) {
+		v.recorder.Event(hpa, v1.EventTypeNormal, annotatedMetrics, "Metrics annotations updated")
+	}
+	return true, nil
+}
+
+// patchRequest returns the merge patch of the changed annotations, or the apply patch of all the
+// desired annotations when server-side apply is enabled, so the apiserver tracks their ownership
+// and prunes the ones we no longer apply. The apply only prunes the keys owned by our field manager,
+// the stale keys written before, e.g. by the merge patches, are removed once with a merge patch.
+func (v *HPAController) patchRequest(hpa *autoscalingv2.HorizontalPodAutoscaler, desired map[string]string, patch map[string]interface{}) (types.PatchType, []byte, metav1.PatchOptions, error) {
+	mergePatch := v.fieldManager == ""
+	if !mergePatch {
+		if unowned := v.unownedStaleAnnotations(hpa, patch); len(unowned) != 0 {
+			klog.V(2).InfoS("Removing the stale annotations not applied by the field manager with a merge patch",
+				"hpa", klog.KObj(hpa), "fieldManager", v.fieldManager, "annotations", unowned)
+			mergePatch = true
+		}
+	}
+	if mergePatch {
+		data, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": patch,
+			},
+		})
+		return types.MergePatchType, data, metav1.PatchOptions{FieldManager: v.fieldManager}, err
+	}
+
+	annotations := make(map[string]string, len(desired)+1)
+	for key, value := range desired {
+		annotations[key] = value
+	}
+	written, err := writtenAnnotationsValue(desired)
+	if err != nil {
+		return "", nil, metav1.PatchOptions{}, err
+	}
+	annotations[writtenAnnotationsAnnotation] = written
+
+	data, err := json.Marshal(map[string]interface{}{
+		"apiVersion": v.groupVersion.String(),
+		"kind":       "HorizontalPodAutoscaler",
+		"metadata": map[string]interface{}{
+			"name":        hpa.Name,
+			"namespace":   hpa.Namespace,
+			"annotations": annotations,
+		},
+	})
+	// the managed annotations are ours, take them over from any other field manager
+	force := true
+	return types.ApplyPatchType, data, metav1.PatchOptions{FieldManager: v.fieldManager, Force: &force}, err
+}
+
+// unownedStaleAnnotations returns the annotations removed by the patch which aren't applied by our field manager,
+// leaving them out of the apply patch doesn't prune them.
+func (v *HPAController) unownedStaleAnnotations(hpa *autoscalingv2.HorizontalPodAutoscaler, patch map[string]interface{}) []string {
+	var owned sets.String
+	var unowned []string
+	for key, value := range patch {
+		if value != nil {
+			continue
+		}
+		if owned == nil {
+			owned = appliedAnnotations(hpa, v.fieldManager)
+		}
+		if !owned.Has(key) {
+			unowned = append(unowned, key)
+		}
+	}
+	sort.Strings(unowned)
+	return unowned
+}
+
+// appliedAnnotations returns the annotation keys owned by the apply operations of the field manager.
+func appliedAnnotations(hpa *autoscalingv2.HorizontalPodAutoscaler, fieldManager string) sets.String {
+	owned := sets.NewString()
+	for _, entry := range hpa.ManagedFields {
+		if entry.Manager != fieldManager || entry.Operation != metav1.ManagedFieldsOperationApply || entry.FieldsV1 == nil {
+			continue
+		}
+		var fields struct {
+			Metadata struct {
+				Annotations map[string]interface{} `json:"f:annotations"`
+			} `json:"f:metadata"`
+		}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			klog.V(4).InfoS("Failed to parse the managed fields of hpa", "hpa", klog.KObj(hpa), "manager", fieldManager, "err", err)
+			continue
+		}
+		for field := range fields.Metadata.Annotations {
+			owned.Insert(strings.TrimPrefix(field, "f:"))
+		}
+	}
+	return owned
 }
 
 func (v *HPAController) handleErr(err error, key interface{}) {
 	if err == nil {
-		v.queue.Forget(key)
+		reconcileTotal.WithLabelValues(resultSuccess).Inc()
+		v.forget(key)
 		return
 	}
 
-	if v.queue.NumRequeues(key) < maxRetries {
-		klog.V(2).Info("Error syncing hpa, retrying.", "key", key, "error", err)
+	reconcileTotal.WithLabelValues(resultError).Inc()
+
+	if retriable(err) && v.queue.NumRequeues(key)+v.fixedDelayAttempts.get(key) < v.maxRetries {
+		if delay, ok := v.fixedDelay(err); ok {
+			klog.V(2).InfoS("Error syncing hpa, retrying after a fixed delay", "key", key, "err", err, "delay", delay)
+			v.fixedDelayAttempts.inc(key)
+			v.queue.AddAfter(key, delay)
+			return
+		}
+		klog.V(2).InfoS("Error syncing hpa, retrying", "key", key, "err", err)
 		v.queue.AddRateLimited(key)
 		return
 	}
 
-	klog.V(4).Info("Dropping hpa out of the queue", "key", key, "error", err)
-	v.queue.Forget(key)
+	klog.V(4).InfoS("Dropping hpa out of the queue", "key", key, "err", err)
+	v.forget(key)
+	droppedTotal.Inc()
 	utilruntime.HandleError(err)
+	if v.deadLetterHandler != nil {
+		v.deadLetterHandler(key.(string), err)
+	}
 }
 
-func (v *HPAController) annotations(hpa *v2.HorizontalPodAutoscaler) map[string]string {
-	if len(hpa.Spec.Metrics) == 0 {
-		return nil
-	}
+// forget clears the retries of the hpa, both the rate limited and the fixed delay ones.
+func (v *HPAController) forget(key interface{}) {
+	v.queue.Forget(key)
+	v.fixedDelayAttempts.forget(key)
+}
+
+// versionCache records the resourceVersions of the hpas written by the controller.
+type versionCache struct {
+	sync.Mutex
+	versions map[string]string
+}
 
-	m := make(map[string]string, 0)
+func newVersionCache() *versionCache {
+	return &versionCache{versions: make(map[string]string)}
+}
 
-	for _, metric := range hpa.Spec.Metrics {
-		if metric.Resource != nil {
-			if metric.Resource.Name == v1.ResourceCPU {
-				m["cpuTargetUtilization"] = fmt.Sprintf("%d", *metric.Resource.Target.AverageUtilization)
-			}
+func (c *versionCache) set(key, version string) {
+	if version == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.versions[key] = version
+}
 
-			if metric.Resource.Name == v1.ResourceMemory {
-				m["memoryTargetValue"] = fmt.Sprintf("%d", *metric.Resource.Target.AverageUtilization)
-			}
-		}
+// consume returns true if the version of the hpa was written by the controller, and forgets it.
+func (c *versionCache) consume(key, version string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if written, ok := c.versions[key]; ok && written == version {
+		delete(c.versions, key)
+		return true
 	}
+	return false
+}
 
-	return m
+func (c *versionCache) delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.versions, key)
 }
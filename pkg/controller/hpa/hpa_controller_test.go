@@ -0,0 +1,1747 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	clientset "k8s.io/client-go/kubernetes"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/metrics/testutil"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+type fixture struct {
+	t *testing.T
+
+	kubeclient *k8sfake.Clientset
+	informers  kubeinformers.SharedInformerFactory
+	controller *HPAController
+}
+
+func newFixture(t *testing.T, hpas ...*v2.HorizontalPodAutoscaler) *fixture {
+	return newFixtureWithOptions(t, nil, hpas...)
+}
+
+func newFixtureWithOptions(t *testing.T, opts []Option, hpas ...*v2.HorizontalPodAutoscaler) *fixture {
+	objects := make([]runtime.Object, 0, len(hpas))
+	for _, hpa := range hpas {
+		objects = append(objects, hpa)
+	}
+
+	f := &fixture{t: t}
+	f.kubeclient = k8sfake.NewSimpleClientset(objects...)
+	f.informers = kubeinformers.NewSharedInformerFactory(f.kubeclient, 0)
+	f.controller = NewHPAController(f.informers.Autoscaling().V2().HorizontalPodAutoscalers(), f.kubeclient, opts...)
+
+	for _, hpa := range hpas {
+		f.updateLister(hpa)
+	}
+
+	return f
+}
+
+// updateLister replaces the object in the informer cache so that the next
+// sync observes it.
+func (f *fixture) updateLister(hpa *v2.HorizontalPodAutoscaler) {
+	if err := f.informers.Autoscaling().V2().HorizontalPodAutoscalers().Informer().GetIndexer().Update(hpa); err != nil {
+		f.t.Fatalf("failed to update lister: %v", err)
+	}
+}
+
+func (f *fixture) sync(hpa *v2.HorizontalPodAutoscaler) {
+	key, err := cache.MetaNamespaceKeyFunc(hpa)
+	if err != nil {
+		f.t.Fatalf("failed to get key: %v", err)
+	}
+	// the batched syncs are pending until the batch is flushed
+	if err := f.controller.syncHPA(context.Background(), key); err != nil && err != errPending {
+		f.t.Fatalf("error syncing hpa: %v", err)
+	}
+}
+
+func (f *fixture) patchActions() []core.PatchAction {
+	var patches []core.PatchAction
+	for _, action := range f.kubeclient.Actions() {
+		if patch, ok := action.(core.PatchAction); ok && action.Matches("patch", "horizontalpodautoscalers") {
+			patches = append(patches, patch)
+		}
+	}
+	return patches
+}
+
+// get returns the object stored by the fake client.
+func (f *fixture) get(hpa *v2.HorizontalPodAutoscaler) *v2.HorizontalPodAutoscaler {
+	got, err := f.kubeclient.AutoscalingV2().HorizontalPodAutoscalers(hpa.Namespace).Get(context.Background(), hpa.Name, metav1.GetOptions{})
+	if err != nil {
+		f.t.Fatalf("failed to get hpa: %v", err)
+	}
+	return got
+}
+
+func newHPA(name string, metrics ...v2.MetricSpec) *v2.HorizontalPodAutoscaler {
+	return &v2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+		},
+		Spec: v2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: v2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       name,
+			},
+			MaxReplicas: 10,
+			Metrics:     metrics,
+		},
+	}
+}
+
+func TestSyncRemovesStaleAnnotations(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	hpa.Annotations = map[string]string{"user": "keep"}
+	f := newFixture(t, hpa)
+
+	f.sync(hpa)
+	got := f.get(hpa)
+	if got.Annotations["cpuTargetUtilization"] != "80" {
+		t.Fatalf("expected cpuTargetUtilization 80, got %v", got.Annotations)
+	}
+
+	got.Spec.Metrics = nil
+	f.updateLister(got)
+	f.sync(got)
+
+	got = f.get(hpa)
+	if _, ok := got.Annotations["cpuTargetUtilization"]; ok {
+		t.Errorf("expected cpuTargetUtilization to be removed, got %v", got.Annotations)
+	}
+	if got.Annotations["user"] != "keep" {
+		t.Errorf("expected user annotation to be kept, got %v", got.Annotations)
+	}
+}
+
+func TestSyncSkipsUpdateWhenUnchanged(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	f.sync(hpa)
+	f.updateLister(f.get(hpa))
+	f.sync(hpa)
+
+	if patches := f.patchActions(); len(patches) != 1 {
+		t.Errorf("expected 1 patch, got %d", len(patches))
+	}
+}
+
+func TestSyncSkipsUpdateWhenLastScaleTimeUnchanged(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	lastScaleTime := metav1.NewTime(time.Date(2023, 3, 1, 8, 30, 0, 0, time.UTC))
+	hpa.Status.LastScaleTime = &lastScaleTime
+	f := newFixture(t, hpa)
+
+	f.sync(hpa)
+	f.updateLister(f.get(hpa))
+	f.sync(hpa)
+
+	if patches := f.patchActions(); len(patches) != 1 {
+		t.Errorf("expected 1 patch, got %d", len(patches))
+	}
+}
+
+func TestSyncPatchesOnlyAnnotations(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	hpa.Annotations = map[string]string{"memoryTargetValue": "512Mi"}
+	f := newFixture(t, hpa)
+
+	f.sync(hpa)
+
+	patches := f.patchActions()
+	if len(patches) != 1 {
+		t.Fatalf("expected 1 patch, got %d", len(patches))
+	}
+	if patches[0].GetPatchType() != types.MergePatchType {
+		t.Errorf("expected merge patch, got %s", patches[0].GetPatchType())
+	}
+
+	var patch map[string]map[string]map[string]*string
+	if err := json.Unmarshal(patches[0].GetPatch(), &patch); err != nil {
+		t.Fatalf("failed to unmarshal patch %s: %v", patches[0].GetPatch(), err)
+	}
+	if len(patch) != 1 || len(patch["metadata"]) != 1 {
+		t.Fatalf("expected the patch to only touch metadata.annotations, got %s", patches[0].GetPatch())
+	}
+	annotations, ok := patch["metadata"]["annotations"]
+	if !ok {
+		t.Fatalf("expected the patch to touch metadata.annotations, got %s", patches[0].GetPatch())
+	}
+	if got := annotations["cpuTargetUtilization"]; got == nil || *got != "80" {
+		t.Errorf("expected cpuTargetUtilization=80 in the patch, got %v", annotations)
+	}
+	if got, ok := annotations["memoryTargetValue"]; !ok || got != nil {
+		t.Errorf("expected the stale memoryTargetValue to be removed, got %v", annotations)
+	}
+	if got := annotations[writtenAnnotationsAnnotation]; got == nil || !strings.Contains(*got, `"cpuTargetUtilization"`) {
+		t.Errorf("expected cpuTargetUtilization to be recorded as written, got %v", annotations)
+	}
+}
+
+func TestDeleteHPA(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t)
+
+	tests := []interface{}{
+		hpa,
+		cache.DeletedFinalStateUnknown{Key: "default/test", Obj: hpa},
+	}
+
+	for _, obj := range tests {
+		f.controller.deleteHPA(obj)
+		if got := f.controller.queue.Len(); got != 1 {
+			t.Fatalf("expected 1 item in queue, got %d", got)
+		}
+
+		if !f.controller.processNextWorkItem(context.Background()) {
+			t.Fatalf("expected item to be processed")
+		}
+		if got := f.controller.queue.NumRequeues("default/test"); got != 0 {
+			t.Errorf("expected deleted hpa to be synced without error, got %d requeues", got)
+		}
+	}
+
+	if patches := f.patchActions(); len(patches) != 0 {
+		t.Errorf("expected no patch for deleted hpa, got %d", len(patches))
+	}
+}
+
+func TestSyncRecordsEvents(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+	recorder := record.NewFakeRecorder(10)
+	f.controller.recorder = recorder
+
+	f.sync(hpa)
+	expectEvent(t, recorder, v1.EventTypeNormal, annotatedMetrics)
+
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("injected error")
+	})
+	f.updateLister(newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 60)))
+	key, _ := cache.MetaNamespaceKeyFunc(hpa)
+	if err := f.controller.syncHPA(context.Background(), key); err == nil {
+		t.Fatalf("expected sync to fail")
+	}
+	expectEvent(t, recorder, v1.EventTypeWarning, failedAnnotateMetrics)
+}
+
+func TestSyncRecordsNoEventForStatusAnnotations(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithStatusAnnotations()}, hpa)
+	recorder := record.NewFakeRecorder(10)
+	f.controller.recorder = recorder
+
+	f.sync(hpa)
+	expectEvent(t, recorder, v1.EventTypeNormal, annotatedMetrics)
+
+	scaled := f.get(hpa)
+	scaled.Status.CurrentReplicas = 4
+	f.updateLister(scaled)
+	f.sync(scaled)
+	if got := f.get(hpa).Annotations["currentReplicas"]; got != "4" {
+		t.Errorf("expected currentReplicas=4, got %q", got)
+	}
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("expected no event when only the status annotations change, got %q", event)
+	default:
+	}
+}
+
+func expectEvent(t *testing.T, recorder *record.FakeRecorder, eventType, reason string) {
+	t.Helper()
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, eventType+" "+reason+" ") {
+			t.Errorf("expected %s event with reason %s, got %q", eventType, reason, event)
+		}
+	default:
+		t.Errorf("expected %s event with reason %s, got none", eventType, reason)
+	}
+}
+
+func TestNamespaceRestriction(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	other := newHPA("other", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	other.Namespace = "other"
+	f := newFixtureWithOptions(t, []Option{WithNamespace(metav1.NamespaceDefault)}, hpa, other)
+
+	f.controller.enqueueHPA(other)
+	if got := f.controller.queue.Len(); got != 0 {
+		t.Errorf("expected hpa in other namespace to be ignored, got %d items in queue", got)
+	}
+
+	f.controller.enqueueHPA(hpa)
+	if got := f.controller.queue.Len(); got != 1 {
+		t.Errorf("expected hpa in managed namespace to be enqueued, got %d items in queue", got)
+	}
+
+	f.sync(other)
+	if patches := f.patchActions(); len(patches) != 0 {
+		t.Errorf("expected hpa in other namespace not to be patched, got %d patches", len(patches))
+	}
+
+	f.sync(hpa)
+	if patches := f.patchActions(); len(patches) != 1 {
+		t.Errorf("expected hpa in managed namespace to be patched, got %d patches", len(patches))
+	}
+}
+
+func TestNamespacesAllowlist(t *testing.T) {
+	newNamespacedHPA := func(namespace string) *v2.HorizontalPodAutoscaler {
+		hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+		hpa.Namespace = namespace
+		return hpa
+	}
+	tenantA := newNamespacedHPA("tenant-a")
+	tenantB := newNamespacedHPA("tenant-b")
+	excluded := newNamespacedHPA("tenant-c")
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		hpa      *v2.HorizontalPodAutoscaler
+		expected bool
+	}{
+		{name: "first included namespace", opts: []Option{WithNamespaces([]string{"tenant-a", "tenant-b"})}, hpa: tenantA, expected: true},
+		{name: "second included namespace", opts: []Option{WithNamespaces([]string{"tenant-a", "tenant-b"})}, hpa: tenantB, expected: true},
+		{name: "excluded namespace", opts: []Option{WithNamespaces([]string{"tenant-a", "tenant-b"})}, hpa: excluded, expected: false},
+		{name: "empty allowlist", opts: []Option{WithNamespaces(nil)}, hpa: excluded, expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixtureWithOptions(t, test.opts, test.hpa)
+
+			f.controller.enqueueHPA(test.hpa)
+			if got := f.controller.queue.Len() == 1; got != test.expected {
+				t.Errorf("expected enqueued %v, got %v", test.expected, got)
+			}
+
+			f.sync(test.hpa)
+			if got := len(f.patchActions()) == 1; got != test.expected {
+				t.Errorf("expected patched %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSelectorFiltering(t *testing.T) {
+	matching := newHPA("matching", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	matching.Labels = map[string]string{"app": "web"}
+	other := newHPA("other", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithSelector("app=web")}, matching, other)
+
+	f.controller.enqueueHPA(other)
+	if got := f.controller.queue.Len(); got != 0 {
+		t.Errorf("expected non-matching hpa to be ignored, got %d items in queue", got)
+	}
+	f.sync(other)
+	if patches := f.patchActions(); len(patches) != 0 {
+		t.Errorf("expected non-matching hpa not to be patched, got %d patches", len(patches))
+	}
+
+	f.controller.enqueueHPA(matching)
+	if got := f.controller.queue.Len(); got != 1 {
+		t.Errorf("expected matching hpa to be enqueued, got %d items in queue", got)
+	}
+	f.sync(matching)
+	if patches := f.patchActions(); len(patches) != 1 {
+		t.Errorf("expected matching hpa to be patched, got %d patches", len(patches))
+	}
+}
+
+func TestEnqueueHPAUnwrapsTombstone(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t)
+
+	f.controller.enqueueHPA(cache.DeletedFinalStateUnknown{Key: "stale/key", Obj: hpa})
+	if got := f.controller.queue.Len(); got != 1 {
+		t.Fatalf("expected the hpa of the tombstone to be enqueued, got %d items in queue", got)
+	}
+	key, _ := f.controller.queue.Get()
+	if key != "default/test" {
+		t.Errorf("expected key default/test, got %v", key)
+	}
+	f.controller.queue.Done(key)
+
+	f.controller.enqueueHPA(cache.DeletedFinalStateUnknown{Key: "default/broken", Obj: "not an hpa"})
+	if got := f.controller.queue.Len(); got != 0 {
+		t.Errorf("expected a tombstone without an object to be skipped, got %d items in queue", got)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of klog.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestHandleErrLogsStructuredFields(t *testing.T) {
+	// the output is swapped instead of the logger, other tests may still be logging from their goroutines
+	var out syncBuffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&out)
+	defer func() {
+		klog.SetOutput(io.Discard)
+		klog.LogToStderr(true)
+	}()
+
+	var verbosity klog.Level
+	if err := verbosity.Set("4"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = verbosity.Set("0") }()
+
+	f := newFixtureWithOptions(t, []Option{WithMaxRetries(1)})
+	syncErr := fmt.Errorf("injected error")
+	f.controller.handleErr(syncErr, "default/test")
+	f.controller.handleErr(syncErr, "default/test")
+	klog.Flush()
+
+	expected := []string{
+		`"Error syncing hpa, retrying" key="default/test" err="injected error"`,
+		`"Dropping hpa out of the queue" key="default/test" err="injected error"`,
+	}
+	logs := out.String()
+	for _, want := range expected {
+		if !strings.Contains(logs, want) {
+			t.Errorf("expected a log line containing %s, got %s", want, logs)
+		}
+	}
+}
+
+func TestProcessNextWorkItemRequeuesPanickingSync(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		panic("boom")
+	})
+
+	f.controller.enqueueHPA(hpa)
+	if !f.controller.processNextWorkItem(withWorker(context.Background(), 3)) {
+		t.Fatal("expected the worker to keep processing after a panic")
+	}
+
+	if requeues := f.controller.queue.NumRequeues("default/test"); requeues != 1 {
+		t.Errorf("expected the panicking hpa to be requeued once, got %d requeues", requeues)
+	}
+}
+
+func TestSyncRetriesConflictWithLiveHPA(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	conflicts := 0
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, apierrors.NewConflict(v2.Resource("horizontalpodautoscalers"), hpa.Name, fmt.Errorf("the object has been modified"))
+	})
+
+	droppedBefore, _ := testutil.GetCounterMetricValue(droppedTotal)
+	f.controller.enqueueHPA(hpa)
+	f.controller.processNextWorkItem(context.Background())
+
+	if patches := f.patchActions(); len(patches) != 2 {
+		t.Fatalf("expected the conflicting patch to be retried once, got %d patches", len(patches))
+	}
+	gets := 0
+	for _, action := range f.kubeclient.Actions() {
+		if action.Matches("get", "horizontalpodautoscalers") {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Errorf("expected the live hpa to be read once, got %d gets", gets)
+	}
+	if got := f.get(hpa); got.Annotations["cpuTargetUtilization"] != "80" {
+		t.Errorf("expected the retry to annotate the hpa, got %v", got.Annotations)
+	}
+	if requeues := f.controller.queue.NumRequeues("default/test"); requeues != 0 {
+		t.Errorf("expected the hpa not to be requeued, got %d requeues", requeues)
+	}
+	if dropped, _ := testutil.GetCounterMetricValue(droppedTotal); dropped != droppedBefore {
+		t.Errorf("expected the hpa not to be dropped, got %v drops", dropped-droppedBefore)
+	}
+}
+
+func TestSyncRetriesConflictWithLiveAnnotations(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	// the hpa is changed concurrently, the lister still serves the stale one
+	conflicts := 0
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		live := hpa.DeepCopy()
+		live.Spec.Metrics = []v2.MetricSpec{resourceUtilizationMetric(v1.ResourceCPU, 50)}
+		if err := f.kubeclient.Tracker().Update(v2.SchemeGroupVersion.WithResource("horizontalpodautoscalers"), live, live.Namespace); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil, apierrors.NewConflict(v2.Resource("horizontalpodautoscalers"), hpa.Name, fmt.Errorf("the object has been modified"))
+	})
+
+	f.sync(hpa)
+
+	if got := f.get(hpa).Annotations["cpuTargetUtilization"]; got != "50" {
+		t.Errorf("expected the annotations of the live hpa, got cpuTargetUtilization %q", got)
+	}
+}
+
+func TestSyncRespectsContext(t *testing.T) {
+	// the server holds the patch requests until the client gives up or the test ends
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := clientset.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+
+	tests := []struct {
+		name string
+		opts []Option
+		ctx  func() (context.Context, context.CancelFunc)
+	}{
+		{
+			name: "canceled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(100*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+		},
+		{
+			name: "reconcile timeout",
+			opts: []Option{WithReconcileTimeout(100 * time.Millisecond)},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			informers := kubeinformers.NewSharedInformerFactory(k8sfake.NewSimpleClientset(), 0)
+			hpaInformer := informers.Autoscaling().V2().HorizontalPodAutoscalers()
+			v := NewHPAController(hpaInformer, client, test.opts...)
+			v.recorder = record.NewFakeRecorder(10)
+			_ = hpaInformer.Informer().GetIndexer().Add(hpa)
+
+			ctx, cancel := test.ctx()
+			defer cancel()
+
+			start := time.Now()
+			if err := v.syncHPA(ctx, "default/test"); err == nil {
+				t.Fatalf("expected sync to be interrupted")
+			}
+			if elapsed := time.Since(start); elapsed > wait.ForeverTestTimeout/2 {
+				t.Errorf("expected patch to be canceled, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestSyncServerSideApply(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(hpa)
+	}))
+	defer server.Close()
+
+	client, err := clientset.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	informers := kubeinformers.NewSharedInformerFactory(k8sfake.NewSimpleClientset(), 0)
+	hpaInformer := informers.Autoscaling().V2().HorizontalPodAutoscalers()
+	v := NewHPAController(hpaInformer, client, WithServerSideApply("kubesphere-hpa"))
+	v.recorder = record.NewFakeRecorder(10)
+	_ = hpaInformer.Informer().GetIndexer().Add(hpa)
+
+	if err := v.syncHPA(context.Background(), "default/test"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.Method != http.MethodPatch {
+		t.Fatalf("expected a patch request, got %s", r.Method)
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != string(types.ApplyPatchType) {
+		t.Errorf("expected content type %s, got %s", types.ApplyPatchType, contentType)
+	}
+	if fieldManager := r.URL.Query().Get("fieldManager"); fieldManager != "kubesphere-hpa" {
+		t.Errorf("expected field manager kubesphere-hpa, got %q", fieldManager)
+	}
+	if force := r.URL.Query().Get("force"); force != "true" {
+		t.Errorf("expected the apply to be forced, got %q", force)
+	}
+
+	var applied v2.HorizontalPodAutoscaler
+	if err := json.Unmarshal(<-bodies, &applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied.Kind != "HorizontalPodAutoscaler" || applied.APIVersion != v2.SchemeGroupVersion.String() {
+		t.Errorf("expected the apply patch to carry the type meta, got %v", applied.TypeMeta)
+	}
+	if applied.Name != hpa.Name || applied.Namespace != hpa.Namespace {
+		t.Errorf("expected the apply patch of %s/%s, got %s/%s", hpa.Namespace, hpa.Name, applied.Namespace, applied.Name)
+	}
+	if applied.Annotations["cpuTargetUtilization"] != "80" {
+		t.Errorf("expected the managed annotations to be applied, got %v", applied.Annotations)
+	}
+	if len(applied.Spec.Metrics) != 0 {
+		t.Errorf("expected the apply patch to only carry the annotations, got %v", applied.Spec)
+	}
+}
+
+func TestPatchRequestRemovesUnownedStaleAnnotations(t *testing.T) {
+	v := newTestController(WithServerSideApply("kubesphere-hpa"))
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	hpa.Annotations = map[string]string{
+		"cpuTargetUtilization":       "80",
+		"memoryTargetUtilization":    "60",
+		writtenAnnotationsAnnotation: `["cpuTargetUtilization","memoryTargetUtilization"]`,
+	}
+	desired := map[string]string{"cpuTargetUtilization": "80"}
+	applied := metav1.ManagedFieldsEntry{
+		Manager:   "kubesphere-hpa",
+		Operation: metav1.ManagedFieldsOperationApply,
+		FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{` +
+			`"f:cpuTargetUtilization":{},"f:memoryTargetUtilization":{}}}}`)},
+	}
+	updated := applied
+	updated.Operation = metav1.ManagedFieldsOperationUpdate
+
+	tests := []struct {
+		name          string
+		managedFields []metav1.ManagedFieldsEntry
+		expected      types.PatchType
+	}{
+		{name: "applied by the field manager", managedFields: []metav1.ManagedFieldsEntry{applied}, expected: types.ApplyPatchType},
+		{name: "written by a merge patch", managedFields: []metav1.ManagedFieldsEntry{updated}, expected: types.MergePatchType},
+		{name: "written before the option was enabled", expected: types.MergePatchType},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := hpa.DeepCopy()
+			hpa.ManagedFields = test.managedFields
+			patch := v.annotationsPatch(hpa.Annotations, desired)
+
+			pt, data, opts, err := v.patchRequest(hpa, desired, patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pt != test.expected {
+				t.Fatalf("expected a %s patch, got %s: %s", test.expected, pt, data)
+			}
+			if opts.FieldManager != "kubesphere-hpa" {
+				t.Errorf("expected the field manager kubesphere-hpa, got %q", opts.FieldManager)
+			}
+			if pt == types.MergePatchType && !strings.Contains(string(data), `"memoryTargetUtilization":null`) {
+				t.Errorf("expected the merge patch to remove memoryTargetUtilization, got %s", data)
+			}
+		})
+	}
+}
+
+func TestUpdateHPASkipsOwnPatches(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	hpa.ResourceVersion = "5"
+	f := newFixture(t, hpa)
+
+	f.sync(hpa)
+	patched := f.get(hpa)
+
+	old := hpa.DeepCopy()
+	old.ResourceVersion = "4"
+	f.controller.updateHPA(old, patched)
+	if got := f.controller.queue.Len(); got != 0 {
+		t.Errorf("expected our own update not to be enqueued, got %d items in queue", got)
+	}
+
+	changed := patched.DeepCopy()
+	changed.ResourceVersion = "6"
+	f.controller.updateHPA(patched, changed)
+	if got := f.controller.queue.Len(); got != 1 {
+		t.Errorf("expected foreign update to be enqueued, got %d items in queue", got)
+	}
+}
+
+func TestRunDrainsQueueOnShutdown(t *testing.T) {
+	var hpas []*v2.HorizontalPodAutoscaler
+	for _, name := range []string{"a", "b", "c"} {
+		hpas = append(hpas, newHPA(name, resourceUtilizationMetric(v1.ResourceCPU, 80)))
+	}
+	f := newFixture(t, hpas...)
+
+	started := make(chan struct{})
+	var once sync.Once
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		once.Do(func() { close(started) })
+		time.Sleep(100 * time.Millisecond)
+		return false, nil, nil
+	})
+
+	stopCh := make(chan struct{})
+	f.informers.Start(stopCh)
+	for _, hpa := range hpas {
+		f.controller.enqueueHPA(hpa)
+	}
+
+	done := make(chan error)
+	runStopCh := make(chan struct{})
+	go func() {
+		done <- f.controller.Run(1, runStopCh)
+	}()
+
+	<-started
+	close(runStopCh)
+	close(stopCh)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("Run didn't return after stop")
+	}
+
+	if patches := f.patchActions(); len(patches) != len(hpas) {
+		t.Errorf("expected all %d queued hpas to be processed, got %d patches", len(hpas), len(patches))
+	}
+}
+
+func TestRunStartsConfiguredWorkers(t *testing.T) {
+	const workers = 3
+	var hpas []*v2.HorizontalPodAutoscaler
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		hpas = append(hpas, newHPA(name, resourceUtilizationMetric(v1.ResourceCPU, 80)))
+	}
+	var mu sync.Mutex
+	inflight, maxInflight := 0, 0
+	release := make(chan struct{})
+	// the enricher runs in every sync, the fake client serializes the patches
+	enricher := func(hpa *v2.HorizontalPodAutoscaler) map[string]string {
+		mu.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		return nil
+	}
+	f := newFixtureWithOptions(t, []Option{WithWorkers(workers), WithAnnotationEnricher(enricher)}, hpas...)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+	for _, hpa := range hpas {
+		f.controller.enqueueHPA(hpa)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- f.controller.Start(ctx)
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return inflight == workers, nil
+	})
+	if err != nil {
+		t.Errorf("expected %d concurrent syncs: %v", workers, err)
+	}
+	// gives a worker too many the time to pick up another hpa
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("Start didn't return after cancel")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInflight != workers {
+		t.Errorf("expected at most %d concurrent syncs, got %d", workers, maxInflight)
+	}
+}
+
+func TestRunRespectsShutdownTimeout(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithShutdownTimeout(100 * time.Millisecond)}, hpa)
+
+	// the handler is stuck and ignores the cancellation of the sync
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		close(started)
+		<-release
+		return false, nil, nil
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+	f.controller.enqueueHPA(hpa)
+
+	done := make(chan error)
+	runStopCh := make(chan struct{})
+	go func() {
+		done <- f.controller.Run(1, runStopCh)
+	}()
+
+	<-started
+	close(runStopCh)
+	start := time.Now()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > wait.ForeverTestTimeout/2 {
+			t.Errorf("expected Run to return after the shutdown timeout, took %v", elapsed)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("Run didn't return after the shutdown timeout")
+	}
+}
+
+func TestEventsAreAggregated(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []Option
+		expected int32
+	}{
+		{name: "identical events are counted", expected: 5},
+		{name: "events are rate limited", options: []Option{WithEventCorrelatorOptions(record.CorrelatorOptions{BurstSize: 2, QPS: 1.0 / 300})}, expected: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+			f := newFixtureWithOptions(t, test.options, hpa)
+			// the events are sent by RunWithContext
+			f.controller.eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: f.kubeclient.CoreV1().Events("")})
+			defer f.controller.eventBroadcaster.Shutdown()
+
+			for i := 0; i < 5; i++ {
+				f.controller.recorder.Event(hpa, v1.EventTypeNormal, annotatedMetrics, "Metrics annotations updated")
+			}
+
+			var events *v1.EventList
+			err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				var err error
+				events, err = f.kubeclient.CoreV1().Events(hpa.Namespace).List(context.Background(), metav1.ListOptions{})
+				return err == nil && len(events.Items) == 1 && events.Items[0].Count == test.expected, err
+			})
+			if err != nil {
+				t.Fatalf("expected a single event counted %d times, got %+v", test.expected, events.Items)
+			}
+		})
+	}
+}
+
+func TestSyncWarnsOnZeroMetrics(t *testing.T) {
+	hpa := newHPA("test")
+	f := newFixture(t, hpa)
+	recorder := record.NewFakeRecorder(10)
+	f.controller.recorder = recorder
+
+	f.sync(hpa)
+	expectEvent(t, recorder, v1.EventTypeWarning, noMetricsConfigured)
+}
+
+func TestSyncSkipsPausedHPA(t *testing.T) {
+	paused := newHPA("paused", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	paused.Annotations = map[string]string{pausedAnnotation: "true"}
+	unpaused := newHPA("unpaused", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	unpaused.Annotations = map[string]string{pausedAnnotation: "false"}
+	f := newFixture(t, paused, unpaused)
+
+	f.sync(paused)
+	f.sync(unpaused)
+
+	patches := f.patchActions()
+	if len(patches) != 1 {
+		t.Fatalf("expected 1 patch, got %d", len(patches))
+	}
+	if name := patches[0].GetName(); name != unpaused.Name {
+		t.Errorf("expected hpa %s to be patched, got %s", unpaused.Name, name)
+	}
+	if got := f.get(paused); got.Annotations["cpuTargetUtilization"] != "" {
+		t.Errorf("expected paused hpa not to be annotated, got %v", got.Annotations)
+	}
+}
+
+func TestSyncChangeDetector(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	hpa.Annotations = map[string]string{"cpuTargetUtilization": " 80 "}
+	// ignoreWhitespace only updates the hpas whose annotations differ beyond whitespace
+	ignoreWhitespace := func(existing, desired map[string]string) bool {
+		for key, value := range desired {
+			if strings.TrimSpace(existing[key]) != strings.TrimSpace(value) {
+				return true
+			}
+		}
+		return false
+	}
+	f := newFixtureWithOptions(t, []Option{WithChangeDetector(ignoreWhitespace)}, hpa)
+
+	// only the whitespace of cpuTargetUtilization differs, the other annotations are missing
+	f.sync(hpa)
+	if patches := f.patchActions(); len(patches) != 1 {
+		t.Fatalf("expected the missing annotations to be written, got %d patches", len(patches))
+	}
+
+	got := f.get(hpa)
+	got.Annotations["cpuTargetUtilization"] = "80 "
+	got, err := f.kubeclient.AutoscalingV2().HorizontalPodAutoscalers(got.Namespace).Update(context.Background(), got, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.updateLister(got)
+
+	f.sync(got)
+	if patches := f.patchActions(); len(patches) != 1 {
+		t.Errorf("expected the detector to suppress the update, got %d patches", len(patches))
+	}
+	if value := f.get(hpa).Annotations["cpuTargetUtilization"]; value != "80 " {
+		t.Errorf("expected the annotation to be left as is, got %q", value)
+	}
+}
+
+func TestSyncManageAnnotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []Option
+		manage   map[string]string
+		expected sets.String
+	}{
+		{
+			name:     "opt-out",
+			manage:   map[string]string{"in": "true", "out": "false", "unset": ""},
+			expected: sets.NewString("in", "unset"),
+		},
+		{
+			name:     "opt-in",
+			options:  []Option{WithOptIn()},
+			manage:   map[string]string{"in": "true", "out": "false", "unset": ""},
+			expected: sets.NewString("in"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var hpas []*v2.HorizontalPodAutoscaler
+			for name, manage := range test.manage {
+				hpa := newHPA(name, resourceUtilizationMetric(v1.ResourceCPU, 80))
+				if manage != "" {
+					hpa.Annotations = map[string]string{manageAnnotation: manage}
+				}
+				hpas = append(hpas, hpa)
+			}
+			f := newFixtureWithOptions(t, test.options, hpas...)
+
+			for _, hpa := range hpas {
+				f.sync(hpa)
+			}
+
+			patched := sets.NewString()
+			for _, patch := range f.patchActions() {
+				patched.Insert(patch.GetName())
+			}
+			if !patched.Equal(test.expected) {
+				t.Errorf("expected hpas %v to be patched, got %v", test.expected.List(), patched.List())
+			}
+		})
+	}
+}
+
+func TestSyncSkipsHPAsOwnedByOperators(t *testing.T) {
+	controller := true
+	keda := newHPA("keda-hpa-test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	keda.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "keda.sh/v1alpha1",
+		Kind:       "ScaledObject",
+		Name:       "test",
+		UID:        "1",
+		Controller: &controller,
+	}}
+	plain := newHPA("plain", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, keda, plain)
+
+	f.sync(keda)
+	f.sync(plain)
+
+	patches := f.patchActions()
+	if len(patches) != 1 {
+		t.Fatalf("expected 1 patch, got %d", len(patches))
+	}
+	if name := patches[0].GetName(); name != plain.Name {
+		t.Errorf("expected hpa %s to be patched, got %s", plain.Name, name)
+	}
+	if got := f.get(keda); len(got.Annotations) != 0 {
+		t.Errorf("expected keda hpa not to be annotated, got %v", got.Annotations)
+	}
+
+	f = newFixtureWithOptions(t, []Option{WithSkippedOwners()}, keda)
+	f.sync(keda)
+	if patches := f.patchActions(); len(patches) != 1 {
+		t.Errorf("expected keda hpa to be patched without skipped owners, got %d patches", len(patches))
+	}
+}
+
+func TestSyncReconcileTimestamp(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithReconcileTimestamp()}, hpa)
+	fakeClock := clocktesting.NewFakeClock(time.Date(2023, 3, 1, 8, 0, 0, 0, time.UTC))
+	f.controller.clock = fakeClock
+
+	f.sync(hpa)
+	got := f.get(hpa)
+	if timestamp := got.Annotations[lastReconcileTimeAnnotation]; timestamp != "2023-03-01T08:00:00Z" {
+		t.Fatalf("expected lastReconcileTime 2023-03-01T08:00:00Z, got %q", timestamp)
+	}
+
+	// nothing else changed, the timestamp is kept
+	fakeClock.Step(time.Minute)
+	f.updateLister(got)
+	f.sync(got)
+	if patches := f.patchActions(); len(patches) != 1 {
+		t.Fatalf("expected no patch when only the timestamp would change, got %d patches", len(patches))
+	}
+
+	got.Spec.Metrics = []v2.MetricSpec{resourceUtilizationMetric(v1.ResourceCPU, 60)}
+	got, err := f.kubeclient.AutoscalingV2().HorizontalPodAutoscalers(got.Namespace).Update(context.Background(), got, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.updateLister(got)
+	f.sync(got)
+	if timestamp := f.get(hpa).Annotations[lastReconcileTimeAnnotation]; timestamp != "2023-03-01T08:01:00Z" {
+		t.Errorf("expected lastReconcileTime 2023-03-01T08:01:00Z after the annotations changed, got %q", timestamp)
+	}
+}
+
+func TestSyncWithoutReconcileTimestamp(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	f.sync(hpa)
+	if timestamp, ok := f.get(hpa).Annotations[lastReconcileTimeAnnotation]; ok {
+		t.Errorf("expected no lastReconcileTime by default, got %q", timestamp)
+	}
+}
+
+func TestSyncLeavesExcludedKeysUntouched(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	hpa.Annotations = map[string]string{"cpuTargetUtilization": "50"}
+	f := newFixtureWithOptions(t, []Option{WithExcludedKeys([]string{"cpuTargetUtilization"})}, hpa)
+
+	f.sync(hpa)
+	got := f.get(hpa)
+	if value := got.Annotations["cpuTargetUtilization"]; value != "50" {
+		t.Fatalf("expected excluded cpuTargetUtilization to be kept, got %q", value)
+	}
+	if value := got.Annotations["maxReplicas"]; value != "10" {
+		t.Errorf("expected maxReplicas to be written, got %q", value)
+	}
+
+	got.Spec.Metrics = nil
+	got, err := f.kubeclient.AutoscalingV2().HorizontalPodAutoscalers(got.Namespace).Update(context.Background(), got, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.updateLister(got)
+	f.sync(got)
+	if value := f.get(hpa).Annotations["cpuTargetUtilization"]; value != "50" {
+		t.Errorf("expected excluded cpuTargetUtilization not to be pruned, got %q", value)
+	}
+}
+
+func TestReadyzAfterCacheSync(t *testing.T) {
+	f := newFixture(t, newHPA("test"))
+
+	if err := f.controller.Readyz(nil); err == nil {
+		t.Fatal("expected controller not to be ready before cache sync")
+	}
+	if err := f.controller.Healthz(nil); err == nil {
+		t.Fatal("expected controller not to be healthy before workers run")
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+
+	done := make(chan error)
+	runStopCh := make(chan struct{})
+	go func() {
+		done <- f.controller.Run(1, runStopCh)
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return f.controller.Readyz(nil) == nil && f.controller.Healthz(nil) == nil, nil
+	})
+	if err != nil {
+		t.Fatalf("expected controller to become ready and healthy: %v", err)
+	}
+
+	close(runStopCh)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := f.controller.Healthz(nil); err == nil {
+		t.Error("expected controller not to be healthy after stop")
+	}
+}
+
+func TestSyncPrunesOnlyWrittenAnnotations(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	f.sync(hpa)
+	got := f.get(hpa)
+	if got.Annotations["cpuTargetUtilization"] != "80" {
+		t.Fatalf("expected cpuTargetUtilization 80, got %v", got.Annotations)
+	}
+
+	// a managed key set by the user after our last patch is not ours to remove
+	got.Annotations["memoryTargetValue"] = "1Gi"
+	got.Annotations["user"] = "keep"
+	got.Spec.Metrics = []v2.MetricSpec{resourceUtilizationMetric(v1.ResourceMemory, 60)}
+	got, err := f.kubeclient.AutoscalingV2().HorizontalPodAutoscalers(got.Namespace).Update(context.Background(), got, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("failed to update hpa: %v", err)
+	}
+	f.updateLister(got)
+	f.sync(got)
+
+	got = f.get(hpa)
+	if _, ok := got.Annotations["cpuTargetUtilization"]; ok {
+		t.Errorf("expected cpuTargetUtilization to be removed, got %v", got.Annotations)
+	}
+	if got.Annotations["memoryTargetUtilization"] != "60" {
+		t.Errorf("expected memoryTargetUtilization 60, got %v", got.Annotations)
+	}
+	for key, value := range map[string]string{"memoryTargetValue": "1Gi", "user": "keep"} {
+		if got.Annotations[key] != value {
+			t.Errorf("expected annotation %s=%s to be kept, got %v", key, value, got.Annotations)
+		}
+	}
+
+	var written []string
+	if err := json.Unmarshal([]byte(got.Annotations[writtenAnnotationsAnnotation]), &written); err != nil {
+		t.Fatalf("failed to decode written annotations: %v", err)
+	}
+	for _, key := range written {
+		if !f.controller.isManagedAnnotation(key) {
+			t.Errorf("expected only managed keys to be recorded, got %s", key)
+		}
+		if key == "cpuTargetUtilization" {
+			t.Errorf("expected cpuTargetUtilization not to be recorded, got %v", written)
+		}
+	}
+}
+
+// armingClock is a fake clock recording the timers and the tickers armed on it, so a test can
+// wait for a goroutine to wait on the clock before stepping it. The queue waits on the clock too,
+// which rules out HasWaiters.
+type armingClock struct {
+	*clocktesting.FakeClock
+	lock  sync.Mutex
+	armed map[time.Duration]int
+}
+
+func newArmingClock() *armingClock {
+	return &armingClock{FakeClock: clocktesting.NewFakeClock(time.Now()), armed: make(map[time.Duration]int)}
+}
+
+func (c *armingClock) arm(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.armed[d]++
+}
+
+func (c *armingClock) NewTimer(d time.Duration) clock.Timer {
+	c.arm(d)
+	return &armingTimer{Timer: c.FakeClock.NewTimer(d), clock: c}
+}
+
+func (c *armingClock) NewTicker(d time.Duration) clock.Ticker {
+	c.arm(d)
+	return c.FakeClock.NewTicker(d)
+}
+
+// waitArmed waits until n timers or tickers of d have been armed.
+func (c *armingClock) waitArmed(t *testing.T, d time.Duration, n int) {
+	t.Helper()
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.armed[d] >= n, nil
+	})
+	if err != nil {
+		t.Fatalf("expected %d timers of %v to be armed: %v", n, d, err)
+	}
+}
+
+type armingTimer struct {
+	clock.Timer
+	clock *armingClock
+}
+
+func (t *armingTimer) Reset(d time.Duration) bool {
+	t.clock.arm(d)
+	return t.Timer.Reset(d)
+}
+
+func TestResyncEnqueuesAllHPAs(t *testing.T) {
+	hpas := []*v2.HorizontalPodAutoscaler{newHPA("a"), newHPA("b")}
+	fakeClock := newArmingClock()
+	f := newFixtureWithOptions(t, []Option{WithResyncPeriod(time.Minute), WithClock(fakeClock)}, hpas...)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go f.controller.resync(stopCh)
+	fakeClock.waitArmed(t, time.Minute, 1)
+
+	fakeClock.Step(30 * time.Second)
+	if l := f.controller.queue.Len(); l != 0 {
+		t.Fatalf("expected no hpa to be enqueued before the resync period, got %d", l)
+	}
+
+	fakeClock.Step(30 * time.Second)
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return f.controller.queue.Len() == len(hpas), nil
+	})
+	if err != nil {
+		t.Errorf("expected %d hpas to be enqueued after the resync period, got %d", len(hpas), f.controller.queue.Len())
+	}
+}
+
+// spanRecorder is an in-memory span exporter.
+type spanRecorder struct {
+	sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (r *spanRecorder) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	r.Lock()
+	defer r.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *spanRecorder) Shutdown(_ context.Context) error {
+	return nil
+}
+
+func TestResyncAllEnqueuesAllHPAs(t *testing.T) {
+	f := newFixture(t, newHPA("a"), newHPA("b"), newHPA("c"))
+
+	if err := f.controller.ResyncAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make(map[interface{}]bool)
+	for f.controller.queue.Len() > 0 {
+		key, _ := f.controller.queue.Get()
+		keys[key] = true
+		f.controller.queue.Done(key)
+	}
+	expected := map[interface{}]bool{"default/a": true, "default/b": true, "default/c": true}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v to be enqueued, got %v", expected, keys)
+	}
+}
+
+func TestSyncRecordsSpan(t *testing.T) {
+	tests := []struct {
+		name    string
+		synced  bool
+		updated bool
+	}{
+		{name: "updated", updated: true},
+		{name: "unchanged", synced: true, updated: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &spanRecorder{}
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(recorder))
+			hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+			f := newFixtureWithOptions(t, []Option{WithTracer(provider.Tracer("test"))}, hpa)
+			if test.synced {
+				f.sync(hpa)
+				f.updateLister(f.get(hpa))
+				recorder.spans = nil
+			}
+
+			f.sync(hpa)
+
+			if len(recorder.spans) != 1 {
+				t.Fatalf("expected 1 span, got %d", len(recorder.spans))
+			}
+			span := recorder.spans[0]
+			if span.Name() != "hpa.syncHPA" {
+				t.Errorf("expected span hpa.syncHPA, got %s", span.Name())
+			}
+
+			expected := map[attribute.Key]attribute.Value{
+				"namespace": attribute.StringValue(hpa.Namespace),
+				"name":      attribute.StringValue(hpa.Name),
+				"updated":   attribute.BoolValue(test.updated),
+			}
+			got := make(map[attribute.Key]attribute.Value)
+			for _, kv := range span.Attributes() {
+				got[kv.Key] = kv.Value
+			}
+			for key, value := range expected {
+				if got[key] != value {
+					t.Errorf("expected attribute %s=%v, got %v", key, value.Emit(), got[key].Emit())
+				}
+			}
+		})
+	}
+}
+
+func TestHandleErrCallsDeadLetterHandler(t *testing.T) {
+	var droppedKey string
+	var droppedErr error
+	calls := 0
+	handler := func(key string, err error) {
+		calls++
+		droppedKey, droppedErr = key, err
+	}
+	f := newFixtureWithOptions(t, []Option{WithMaxRetries(2), WithDeadLetterHandler(handler)})
+
+	key := "default/test"
+	syncErr := fmt.Errorf("injected error")
+	for i := 0; i < 2; i++ {
+		f.controller.handleErr(syncErr, key)
+		if calls != 0 {
+			t.Fatalf("expected no dead letter before retries are exhausted, got %d after %d errors", calls, i+1)
+		}
+	}
+
+	f.controller.handleErr(syncErr, key)
+	if calls != 1 {
+		t.Fatalf("expected dead letter handler to be called once, got %d", calls)
+	}
+	if droppedKey != key || droppedErr != syncErr {
+		t.Errorf("expected dead letter %s: %v, got %s: %v", key, syncErr, droppedKey, droppedErr)
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithDryRun()}, hpa)
+
+	f.sync(hpa)
+
+	for _, action := range f.kubeclient.Actions() {
+		if action.GetVerb() == "patch" || action.GetVerb() == "update" {
+			t.Errorf("expected no writes in dry run, got %s", action.GetVerb())
+		}
+	}
+	if got := f.get(hpa); len(got.Annotations) != 0 {
+		t.Errorf("expected hpa not to be annotated in dry run, got %v", got.Annotations)
+	}
+}
+
+func TestSyncDryRunRecordsNoEvents(t *testing.T) {
+	noMetrics := newHPA("no-metrics")
+	outOfRange := newHPA("out-of-range", resourceUtilizationMetric(v1.ResourceCPU, 99))
+	f := newFixtureWithOptions(t, []Option{WithDryRun()}, noMetrics, outOfRange)
+	recorder := record.NewFakeRecorder(10)
+	f.controller.recorder = recorder
+
+	f.sync(noMetrics)
+	f.sync(outOfRange)
+
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("expected no event in dry run, got %q", event)
+	default:
+	}
+}
+
+func TestSyncMergesEnrichedAnnotations(t *testing.T) {
+	enrich := true
+	enricher := func(hpa *v2.HorizontalPodAutoscaler) map[string]string {
+		if !enrich {
+			return nil
+		}
+		return map[string]string{
+			"example.com/team":     "payments",
+			"cpuTargetUtilization": "1",
+		}
+	}
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithAnnotationEnricher(enricher)}, hpa)
+
+	f.sync(hpa)
+	got := f.get(hpa)
+	if got.Annotations["example.com/team"] != "payments" {
+		t.Errorf("expected enriched annotation, got %v", got.Annotations)
+	}
+	if got.Annotations["cpuTargetUtilization"] != "80" {
+		t.Errorf("expected the managed cpuTargetUtilization to take precedence, got %v", got.Annotations)
+	}
+
+	enrich = false
+	f.updateLister(got)
+	f.sync(got)
+	if got := f.get(hpa); got.Annotations["example.com/team"] != "" {
+		t.Errorf("expected enriched annotation to be removed, got %v", got.Annotations)
+	}
+}
+
+func TestSyncCapsInflightWrites(t *testing.T) {
+	var hpas []*v2.HorizontalPodAutoscaler
+	for i := 0; i < 10; i++ {
+		hpas = append(hpas, newHPA(fmt.Sprintf("test-%d", i), resourceUtilizationMetric(v1.ResourceCPU, 80)))
+	}
+	f := newFixtureWithOptions(t, []Option{WithWorkers(10), WithMaxInflightWrites(2)}, hpas...)
+
+	var lock sync.Mutex
+	inflight, maxInflight := 0, 0
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		lock.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		lock.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		lock.Lock()
+		inflight--
+		lock.Unlock()
+		return false, nil, nil
+	})
+
+	var wg sync.WaitGroup
+	for _, hpa := range hpas {
+		wg.Add(1)
+		go func(hpa *v2.HorizontalPodAutoscaler) {
+			defer wg.Done()
+			if err := f.controller.syncHPA(context.Background(), hpa.Namespace+"/"+hpa.Name); err != nil {
+				t.Errorf("error syncing hpa: %v", err)
+			}
+		}(hpa)
+	}
+	wg.Wait()
+
+	if maxInflight > 2 {
+		t.Errorf("expected at most 2 concurrent writes, got %d", maxInflight)
+	}
+	if patches := f.patchActions(); len(patches) != len(hpas) {
+		t.Errorf("expected %d patches, got %d", len(hpas), len(patches))
+	}
+}
+
+func TestSyncReleasesWriteSlotOnPanic(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithMaxInflightWrites(1)}, hpa)
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		panic("injected panic")
+	})
+
+	if err := f.controller.syncWithRecovery(context.Background(), hpa.Namespace+"/"+hpa.Name); err == nil {
+		t.Fatal("expected the panic to be returned as an error")
+	}
+	if used := len(f.controller.writes); used != 0 {
+		t.Errorf("expected the write slot to be released, got %d used", used)
+	}
+}
+
+func TestSyncFlagsCPUTargetOutOfRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		target     int32
+		outOfRange bool
+	}{
+		{name: "in range", target: 80},
+		{name: "lower bound", target: 10},
+		{name: "upper bound", target: 95},
+		{name: "too low", target: 5, outOfRange: true},
+		{name: "too high", target: 99, outOfRange: true},
+		{name: "configured range", opts: []Option{WithCPUTargetRange(20, 90)}, target: 15, outOfRange: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, test.target))
+			f := newFixtureWithOptions(t, test.opts, hpa)
+			recorder := record.NewFakeRecorder(10)
+			f.controller.recorder = recorder
+
+			f.sync(hpa)
+
+			got := f.get(hpa)
+			if !test.outOfRange {
+				if _, ok := got.Annotations["targetOutOfRange"]; ok {
+					t.Errorf("expected no targetOutOfRange annotation, got %v", got.Annotations)
+				}
+				expectEvent(t, recorder, v1.EventTypeNormal, annotatedMetrics)
+				return
+			}
+			if got.Annotations["targetOutOfRange"] != "cpu" {
+				t.Errorf("expected targetOutOfRange cpu, got %v", got.Annotations)
+			}
+			expectEvent(t, recorder, v1.EventTypeWarning, targetOutOfRange)
+		})
+	}
+}
+
+func TestRunWithContextReturnsOnCancel(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- f.controller.RunWithContext(ctx, 1)
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return f.controller.Healthz(nil) == nil, nil
+	})
+	if err != nil {
+		t.Fatalf("expected workers to run: %v", err)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("RunWithContext didn't return after cancel")
+	}
+}
+
+type mockController struct {
+	resyncs int
+	stats   ControllerStats
+}
+
+func (m *mockController) Start(ctx context.Context) error { return nil }
+
+func (m *mockController) Run(workers int, stopCh <-chan struct{}) error { return nil }
+
+func (m *mockController) Stats() ControllerStats { return m.stats }
+
+func (m *mockController) ResyncAll() error {
+	m.resyncs++
+	return nil
+}
+
+func TestInterfaceCanBeMocked(t *testing.T) {
+	// resyncIfIdle stands for a host application depending on the Interface.
+	resyncIfIdle := func(c Interface) error {
+		if c.Stats().QueueLength > 0 {
+			return nil
+		}
+		return c.ResyncAll()
+	}
+
+	mock := &mockController{}
+	if err := resyncIfIdle(mock); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mock.resyncs != 1 {
+		t.Errorf("expected the idle mock to be resynced once, got %d", mock.resyncs)
+	}
+
+	mock.stats.QueueLength = 1
+	if err := resyncIfIdle(mock); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mock.resyncs != 1 {
+		t.Errorf("expected the busy mock not to be resynced, got %d resyncs", mock.resyncs)
+	}
+
+	f := newFixture(t, newHPA("test"))
+	if err := resyncIfIdle(f.controller); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := f.controller.queue.Len(); got != 1 {
+		t.Errorf("expected the controller to be resynced through the Interface, got %d queued hpas", got)
+	}
+}
+
+// TestConcurrentSyncsOfDistinctKeys drives the per-hpa state shared by the workers, it's meant to be run with -race.
+func TestConcurrentSyncsOfDistinctKeys(t *testing.T) {
+	lastScaleTime := metav1.Now()
+	var hpas []*v2.HorizontalPodAutoscaler
+	for i := 0; i < 20; i++ {
+		hpa := newHPA(fmt.Sprintf("test-%d", i), resourceUtilizationMetric(v1.ResourceCPU, 80))
+		hpa.Status.LastScaleTime = &lastScaleTime
+		hpas = append(hpas, hpa)
+	}
+	f := newFixtureWithOptions(t, []Option{
+		WithThrashDetection(2, time.Hour),
+		WithMinSyncInterval(time.Millisecond),
+		WithReconcileTimestamp(),
+	}, hpas...)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+
+	runStopCh := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- f.controller.Run(8, runStopCh)
+	}()
+
+	// resync and read the stats while the workers sync the hpas
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := f.controller.ResyncAll(); err != nil {
+				t.Error(err)
+			}
+			_ = f.controller.Stats()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		for _, hpa := range hpas {
+			if f.get(hpa).Annotations["cpuTargetUtilization"] != "80" {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	wg.Wait()
+	close(runStopCh)
+	if runErr := <-done; runErr != nil {
+		t.Fatal(runErr)
+	}
+	if err != nil {
+		t.Fatalf("expected all the hpas to be annotated: %v", err)
+	}
+}
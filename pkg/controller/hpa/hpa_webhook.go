@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	v1 "k8s.io/api/admission/v1"
+	v2 "k8s.io/api/autoscaling/v2"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ValidatingHandler rejects hpas whose replica bounds can't work.
+type ValidatingHandler struct {
+	decoder *admission.Decoder
+}
+
+var _ admission.DecoderInjector = &ValidatingHandler{}
+
+// InjectDecoder injects the decoder into a ValidatingHandler.
+func (h *ValidatingHandler) InjectDecoder(d *admission.Decoder) error {
+	h.decoder = d
+	return nil
+}
+
+// Handle handles admission requests.
+func (h *ValidatingHandler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != v1.Create && req.Operation != v1.Update {
+		return admission.Allowed("")
+	}
+
+	hpa := &v2.HorizontalPodAutoscaler{}
+	if err := h.decoder.DecodeRaw(req.Object, hpa); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if err := validateHPA(hpa); err != nil {
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+func validateHPA(hpa *v2.HorizontalPodAutoscaler) error {
+	if hpa.Spec.MaxReplicas <= 0 {
+		return fmt.Errorf("maxReplicas must be greater than 0, got %d", hpa.Spec.MaxReplicas)
+	}
+	if hpa.Spec.MinReplicas != nil && *hpa.Spec.MinReplicas > hpa.Spec.MaxReplicas {
+		return fmt.Errorf("minReplicas (%d) must not be greater than maxReplicas (%d)", *hpa.Spec.MinReplicas, hpa.Spec.MaxReplicas)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v2 "k8s.io/api/autoscaling/v2"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newAdmissionRequest(t *testing.T, operation admissionv1.Operation, hpa *v2.HorizontalPodAutoscaler) admission.Request {
+	raw, err := json.Marshal(hpa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+func newDecoder(t *testing.T) *admission.Decoder {
+	decoder, err := admission.NewDecoder(scheme.Scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoder
+}
+
+func TestValidatingHandler(t *testing.T) {
+	replicas := func(n int32) *int32 { return &n }
+
+	tests := []struct {
+		name        string
+		minReplicas *int32
+		maxReplicas int32
+		allowed     bool
+	}{
+		{name: "valid", minReplicas: replicas(1), maxReplicas: 10, allowed: true},
+		{name: "default min replicas", maxReplicas: 10, allowed: true},
+		{name: "min equals max", minReplicas: replicas(3), maxReplicas: 3, allowed: true},
+		{name: "min greater than max", minReplicas: replicas(5), maxReplicas: 3, allowed: false},
+		{name: "zero max replicas", maxReplicas: 0, allowed: false},
+		{name: "negative max replicas", minReplicas: replicas(1), maxReplicas: -1, allowed: false},
+	}
+
+	h := &ValidatingHandler{}
+	if err := h.InjectDecoder(newDecoder(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test")
+			hpa.Spec.MinReplicas = test.minReplicas
+			hpa.Spec.MaxReplicas = test.maxReplicas
+
+			for _, operation := range []admissionv1.Operation{admissionv1.Create, admissionv1.Update} {
+				resp := h.Handle(context.Background(), newAdmissionRequest(t, operation, hpa))
+				if resp.Allowed != test.allowed {
+					t.Errorf("%s: expected allowed %v, got %v: %v", operation, test.allowed, resp.Allowed, resp.Result)
+				}
+			}
+		})
+	}
+}
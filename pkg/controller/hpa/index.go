@@ -0,0 +1,73 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"fmt"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	v2 "k8s.io/api/autoscaling/v2"
+	"k8s.io/api/autoscaling/v2beta2"
+)
+
+// scaleTargetIndex indexes the hpas by the namespace/kind/name of their scale target.
+const scaleTargetIndex = "scaleTarget"
+
+func scaleTargetKey(namespace, kind, name string) string {
+	return namespace + "/" + kind + "/" + name
+}
+
+// indexByScaleTarget handles the hpas of all the API versions the controller may watch.
+func indexByScaleTarget(obj interface{}) ([]string, error) {
+	switch hpa := obj.(type) {
+	case *v2.HorizontalPodAutoscaler:
+		return []string{scaleTargetKey(hpa.Namespace, hpa.Spec.ScaleTargetRef.Kind, hpa.Spec.ScaleTargetRef.Name)}, nil
+	case *v2beta2.HorizontalPodAutoscaler:
+		return []string{scaleTargetKey(hpa.Namespace, hpa.Spec.ScaleTargetRef.Kind, hpa.Spec.ScaleTargetRef.Name)}, nil
+	case *autoscalingv1.HorizontalPodAutoscaler:
+		return []string{scaleTargetKey(hpa.Namespace, hpa.Spec.ScaleTargetRef.Kind, hpa.Spec.ScaleTargetRef.Name)}, nil
+	default:
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+}
+
+// HPAsForTarget returns the hpas scaling the workload of kind in the namespace.
+func (v *HPAController) HPAsForTarget(namespace, kind, name string) ([]*v2.HorizontalPodAutoscaler, error) {
+	objs, err := v.hpaIndexer.ByIndex(scaleTargetIndex, scaleTargetKey(namespace, kind, name))
+	if err != nil {
+		return nil, err
+	}
+
+	hpas := make([]*v2.HorizontalPodAutoscaler, 0, len(objs))
+	for _, obj := range objs {
+		switch hpa := obj.(type) {
+		case *v2.HorizontalPodAutoscaler:
+			hpas = append(hpas, hpa)
+		case *v2beta2.HorizontalPodAutoscaler:
+			converted, err := convertV2beta2(hpa)
+			if err != nil {
+				return nil, err
+			}
+			hpas = append(hpas, converted)
+		case *autoscalingv1.HorizontalPodAutoscaler:
+			hpas = append(hpas, convertV1(hpa))
+		default:
+			return nil, fmt.Errorf("unexpected object type %T", obj)
+		}
+	}
+	return hpas, nil
+}
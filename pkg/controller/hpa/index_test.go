@@ -0,0 +1,54 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestHPAsForTarget(t *testing.T) {
+	web := newHPA("web")
+	webMemory := newHPA("web-memory")
+	webMemory.Spec.ScaleTargetRef.Name = "web"
+	other := newHPA("other")
+	statefulSet := newHPA("web-sts")
+	statefulSet.Spec.ScaleTargetRef.Kind = "StatefulSet"
+	statefulSet.Spec.ScaleTargetRef.Name = "web"
+	f := newFixture(t, web, webMemory, other, statefulSet)
+
+	hpas, err := f.controller.HPAsForTarget(web.Namespace, "Deployment", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, hpa := range hpas {
+		names = append(names, hpa.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "web" || names[1] != "web-memory" {
+		t.Errorf("expected hpas [web web-memory], got %v", names)
+	}
+
+	hpas, err = f.controller.HPAsForTarget("kube-system", "Deployment", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hpas) != 0 {
+		t.Errorf("expected no hpas in another namespace, got %d", len(hpas))
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"sync"
+	"time"
+)
+
+// syncInterval remembers the last sync times of the hpas, so a hpa isn't synced more than once per interval.
+type syncInterval struct {
+	sync.Mutex
+	interval time.Duration
+
+	lastSyncs map[string]time.Time
+}
+
+func newSyncInterval(interval time.Duration) *syncInterval {
+	return &syncInterval{
+		interval:  interval,
+		lastSyncs: make(map[string]time.Time),
+	}
+}
+
+// delay returns how long the hpa has to wait before it can be synced again.
+func (s *syncInterval) delay(key string, now time.Time) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+
+	last, ok := s.lastSyncs[key]
+	if !ok {
+		return 0
+	}
+	if delay := last.Add(s.interval).Sub(now); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// observe records the hpa is synced at now.
+func (s *syncInterval) observe(key string, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastSyncs[key] = now
+}
+
+func (s *syncInterval) forget(key string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.lastSyncs, key)
+}
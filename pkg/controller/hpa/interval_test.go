@@ -0,0 +1,102 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestSyncIntervalDelay(t *testing.T) {
+	s := newSyncInterval(time.Minute)
+	now := time.Date(2023, 3, 1, 8, 0, 0, 0, time.UTC)
+
+	if delay := s.delay("default/test", now); delay != 0 {
+		t.Fatalf("expected no delay before the first sync, got %v", delay)
+	}
+
+	s.observe("default/test", now)
+	if delay := s.delay("default/test", now.Add(20*time.Second)); delay != 40*time.Second {
+		t.Errorf("expected delay 40s within the interval, got %v", delay)
+	}
+	if delay := s.delay("default/test", now.Add(time.Minute)); delay != 0 {
+		t.Errorf("expected no delay once the interval passed, got %v", delay)
+	}
+	if delay := s.delay("default/other", now); delay != 0 {
+		t.Errorf("expected no delay for another hpa, got %v", delay)
+	}
+
+	s.forget("default/test")
+	if delay := s.delay("default/test", now); delay != 0 {
+		t.Errorf("expected no delay for a forgotten hpa, got %v", delay)
+	}
+}
+
+func TestMinSyncIntervalBoundsSyncs(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	f := newFixtureWithOptions(t, []Option{WithMinSyncInterval(time.Minute), WithClock(fakeClock)}, hpa)
+	defer f.controller.queue.ShutDown()
+
+	process := func() {
+		t.Helper()
+		if !f.controller.processNextWorkItem(context.Background()) {
+			t.Fatalf("expected the queue to be running")
+		}
+	}
+	expectSyncs := func(expected int64) {
+		t.Helper()
+		if processed := f.controller.Stats().Processed; processed != expected {
+			t.Fatalf("expected %d syncs, got %d", expected, processed)
+		}
+	}
+
+	f.controller.enqueueHPA(hpa)
+	process()
+	expectSyncs(1)
+
+	for i := int64(1); i <= 3; i++ {
+		// the events within the interval are delayed
+		for j := 0; j < 5; j++ {
+			f.controller.enqueueHPA(hpa)
+		}
+		if l := f.controller.queue.Len(); l != 0 {
+			t.Fatalf("expected the hpa to be delayed within the interval, got %d queued", l)
+		}
+		fakeClock.Step(time.Minute - time.Second)
+		if l := f.controller.queue.Len(); l != 0 {
+			t.Fatalf("expected the hpa to be delayed within the interval, got %d queued", l)
+		}
+		expectSyncs(i)
+
+		// and coalesced into a single sync once it has passed
+		fakeClock.Step(time.Second)
+		err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			return f.controller.queue.Len() == 1, nil
+		})
+		if err != nil {
+			t.Fatalf("expected the delayed hpa to be requeued once the interval passed: %v", err)
+		}
+		process()
+		expectSyncs(i + 1)
+	}
+}
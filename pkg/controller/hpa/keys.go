@@ -0,0 +1,104 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// KeyTemplateData describes a metric target annotation to the key template,
+// e.g. metrics.kubesphere.io/{{.Key}} renders metrics.kubesphere.io/cpuTargetUtilization for the
+// cpu target of a Resource metric and metrics.kubesphere.io/podsMetric.packets-per-second for the
+// target of a Pods metric.
+type KeyTemplateData struct {
+	// Key is the default key, e.g. cpuTargetUtilization or podsMetric.packets-per-second.
+	Key string
+	// Source is the type of the metric source, e.g. Resource or Pods.
+	Source string
+	// Resource is the resource of the Resource and ContainerResource metrics, e.g. cpu.
+	Resource string
+	// Container is the container of the ContainerResource metrics.
+	Container string
+	// Metric is the name of the Pods, Object and External metrics.
+	Metric string
+	// Field is the annotated field: TargetUtilization, TargetValue, Target, DescribedObject or Selector.
+	Field string
+}
+
+// renderKey returns the key of the annotation rendered by tmpl, the default key is used without
+// a template, if the template fails or if it renders an invalid annotation key, e.g. for a metric
+// name the samples of validateKeyTemplate don't cover. ComputeAnnotations leaves out the keys still
+// invalid once prefixed, the default ones included.
+func renderKey(tmpl *template.Template, data KeyTemplateData) string {
+	if tmpl == nil {
+		return data.Key
+	}
+
+	var key strings.Builder
+	if err := tmpl.Execute(&key, data); err != nil {
+		return data.Key
+	}
+	if errs := validation.IsQualifiedName(key.String()); len(errs) != 0 {
+		klog.V(4).InfoS("Rendered an invalid annotation key, using the default one", "key", key.String(), "default", data.Key)
+		return data.Key
+	}
+	return key.String()
+}
+
+// keyTemplateSamples describe every annotated field of every metric source type to validateKeyTemplate.
+var keyTemplateSamples = []KeyTemplateData{
+	{Key: "cpuTargetUtilization", Source: string(resourceSourceType), Resource: "cpu", Field: "TargetUtilization"},
+	{Key: "cpuTargetValue", Source: string(resourceSourceType), Resource: "cpu", Field: "TargetValue"},
+	{Key: "memoryTargetUtilization", Source: string(resourceSourceType), Resource: "memory", Field: "TargetUtilization"},
+	{Key: "memoryTargetValue", Source: string(resourceSourceType), Resource: "memory", Field: "TargetValue"},
+	{Key: "cpuTargetUtilization.app", Source: string(containerResourceSourceType), Resource: "cpu", Container: "app", Field: "TargetUtilization"},
+	{Key: "cpuTargetValue.app", Source: string(containerResourceSourceType), Resource: "cpu", Container: "app", Field: "TargetValue"},
+	{Key: "memoryTargetUtilization.app", Source: string(containerResourceSourceType), Resource: "memory", Container: "app", Field: "TargetUtilization"},
+	{Key: "memoryTargetValue.app", Source: string(containerResourceSourceType), Resource: "memory", Container: "app", Field: "TargetValue"},
+	{Key: "podsMetric.sample", Source: string(podsSourceType), Metric: "sample", Field: "Target"},
+	{Key: "podsMetricSelector.sample", Source: string(podsSourceType), Metric: "sample", Field: "Selector"},
+	{Key: "objectMetric.sample", Source: string(objectSourceType), Metric: "sample", Field: "Target"},
+	{Key: "objectMetricTarget.sample", Source: string(objectSourceType), Metric: "sample", Field: "DescribedObject"},
+	{Key: "objectMetricSelector.sample", Source: string(objectSourceType), Metric: "sample", Field: "Selector"},
+	{Key: "externalMetric.sample", Source: string(externalSourceType), Metric: "sample", Field: "Target"},
+	{Key: "externalMetricSelector.sample", Source: string(externalSourceType), Metric: "sample", Field: "Selector"},
+}
+
+// validateKeyTemplate renders the keys of keyTemplateSamples with the template and checks they're valid
+// annotation keys once the prefix is prepended, and that no two fields share a key.
+func validateKeyTemplate(tmpl *template.Template, prefix string) error {
+	rendered := make(map[string]string, len(keyTemplateSamples))
+	for _, sample := range keyTemplateSamples {
+		var key strings.Builder
+		if err := tmpl.Execute(&key, sample); err != nil {
+			return fmt.Errorf("invalid key template %q: %v", tmpl.Root.String(), err)
+		}
+		if errs := validation.IsQualifiedName(strings.ToLower(prefix + key.String())); len(errs) != 0 {
+			return fmt.Errorf("invalid key template %q, rendered key %q for %s: %s", tmpl.Root.String(), prefix+key.String(), sample.Key, strings.Join(errs, "; "))
+		}
+		if other, ok := rendered[key.String()]; ok {
+			return fmt.Errorf("invalid key template %q, rendered the same key %q for %s and %s", tmpl.Root.String(), key.String(), other, sample.Key)
+		}
+		rendered[key.String()] = sample.Key
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+)
+
+// ErrLeaderLost is returned by Start when the lease is lost before the context is done, the
+// controller doesn't campaign again and the process is expected to be restarted.
+var ErrLeaderLost = errors.New("leader election lost")
+
+type leaderElectionConfig struct {
+	lockName  string
+	namespace string
+	identity  string
+
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	// lock is built from the fields above when nil
+	lock resourcelock.Interface
+}
+
+func (v *HPAController) newLock() resourcelock.Interface {
+	if v.leaderElection.lock != nil {
+		return v.leaderElection.lock
+	}
+
+	return &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      v.leaderElection.lockName,
+			Namespace: v.leaderElection.namespace,
+		},
+		Client: v.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity:      v.leaderElection.identity,
+			EventRecorder: v.recorder,
+		},
+	}
+}
+
+// runWithLeaderElection blocks until ctx is done or the leadership is lost,
+// the workers are only running while this instance holds the lease. Once leading,
+// it waits for the workers to stop before returning.
+func (v *HPAController) runWithLeaderElection(ctx context.Context) error {
+	started := make(chan struct{})
+	errCh := make(chan error, 1)
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            v.newLock(),
+		Name:            v.leaderElection.lockName,
+		LeaseDuration:   v.leaderElection.leaseDuration,
+		RenewDeadline:   v.leaderElection.renewDeadline,
+		RetryPeriod:     v.leaderElection.retryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.InfoS("Started leading, starting hpa controller", "identity", v.leaderElection.identity)
+				close(started)
+				errCh <- v.RunWithContext(ctx, v.Workers)
+			},
+			OnStoppedLeading: func() {
+				klog.InfoS("Stopped leading", "identity", v.leaderElection.identity)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Run returns as soon as the lease is lost, without waiting for OnStartedLeading
+	elector.Run(ctx)
+
+	select {
+	case <-started:
+	default:
+		return nil
+	}
+	if err := <-errCh; err != nil {
+		return err
+	}
+	if ctx.Err() == nil {
+		return ErrLeaderLost
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// fakeLock refuses to grant the lease until acquirable is set.
+type fakeLock struct {
+	sync.Mutex
+	identity   string
+	acquirable bool
+	lost       bool
+	record     *resourcelock.LeaderElectionRecord
+}
+
+func (l *fakeLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	l.Lock()
+	defer l.Unlock()
+	if l.record == nil {
+		return nil, nil, errors.NewNotFound(schema.GroupResource{Resource: "leases"}, "hpa")
+	}
+	record := *l.record
+	return &record, nil, nil
+}
+
+func (l *fakeLock) Create(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	l.Lock()
+	defer l.Unlock()
+	if !l.acquirable {
+		return fmt.Errorf("lease is held by another instance")
+	}
+	l.record = &ler
+	return nil
+}
+
+func (l *fakeLock) Update(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.lost {
+		return fmt.Errorf("lease is held by another instance")
+	}
+	l.record = &ler
+	return nil
+}
+
+func (l *fakeLock) setAcquirable() {
+	l.Lock()
+	defer l.Unlock()
+	l.acquirable = true
+}
+
+// setLost fails the renewals of the lease.
+func (l *fakeLock) setLost() {
+	l.Lock()
+	defer l.Unlock()
+	l.lost = true
+}
+
+func (l *fakeLock) RecordEvent(string) {}
+
+func (l *fakeLock) Identity() string { return l.identity }
+
+func (l *fakeLock) Describe() string { return "fake/" + l.identity }
+
+func TestLeaderElectionGuardsWorkers(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	lock := &fakeLock{identity: "test"}
+	WithLeaderElection("hpa-controller", "kubesphere-system", "test")(f.controller)
+	f.controller.leaderElection.lock = lock
+	f.controller.leaderElection.leaseDuration = time.Second
+	f.controller.leaderElection.renewDeadline = 500 * time.Millisecond
+	f.controller.leaderElection.retryPeriod = 50 * time.Millisecond
+	f.controller.enqueueHPA(hpa)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+
+	go func() {
+		_ = f.controller.Start(ctx)
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	if patches := f.patchActions(); len(patches) != 0 {
+		t.Fatalf("expected no patch before leadership is acquired, got %d", len(patches))
+	}
+
+	lock.setAcquirable()
+	err := wait.PollImmediate(50*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(f.patchActions()) == 1, nil
+	})
+	if err != nil {
+		t.Errorf("expected hpa to be patched after leadership is acquired: %v", err)
+	}
+}
+
+func TestLeaderElectionLostStopsWorkers(t *testing.T) {
+	f := newFixture(t)
+
+	lock := &fakeLock{identity: "test", acquirable: true}
+	WithLeaderElection("hpa-controller", "kubesphere-system", "test")(f.controller)
+	f.controller.leaderElection.lock = lock
+	f.controller.leaderElection.leaseDuration = time.Second
+	f.controller.leaderElection.renewDeadline = 500 * time.Millisecond
+	f.controller.leaderElection.retryPeriod = 50 * time.Millisecond
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- f.controller.Start(ctx)
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return f.controller.Readyz(nil) == nil, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the workers to start once leading: %v", err)
+	}
+
+	lock.setLost()
+	select {
+	case err := <-errCh:
+		if err != ErrLeaderLost {
+			t.Errorf("expected %v, got %v", ErrLeaderLost, err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("expected Start to return once the lease is lost")
+	}
+	if !f.controller.queue.ShuttingDown() {
+		t.Error("expected the workers to be stopped before Start returns")
+	}
+}
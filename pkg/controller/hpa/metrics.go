@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	compbasemetrics "k8s.io/component-base/metrics"
+
+	"kubesphere.io/kubesphere/pkg/utils/metrics"
+)
+
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+
+	opAdd    = "add"
+	opUpdate = "update"
+	opDelete = "delete"
+)
+
+var (
+	reconcileTotal = compbasemetrics.NewCounterVec(
+		&compbasemetrics.CounterOpts{
+			Name:           "hpa_controller_reconcile_total",
+			Help:           "Counter of hpa reconciles broken out by result",
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+
+	reconcileDuration = compbasemetrics.NewHistogram(
+		&compbasemetrics.HistogramOpts{
+			Name:           "hpa_controller_reconcile_duration_seconds",
+			Help:           "Histogram of the time taken to reconcile an hpa",
+			Buckets:        compbasemetrics.DefBuckets,
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+	)
+
+	queueDepth = compbasemetrics.NewGauge(
+		&compbasemetrics.GaugeOpts{
+			Name:           "hpa_controller_queue_depth",
+			Help:           "Current depth of the hpa controller workqueue",
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+	)
+
+	droppedTotal = compbasemetrics.NewCounter(
+		&compbasemetrics.CounterOpts{
+			Name:           "hpa_controller_dropped_total",
+			Help:           "Counter of hpas dropped out of the queue after the max retries",
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+	)
+
+	cacheSyncDuration = compbasemetrics.NewGauge(
+		&compbasemetrics.GaugeOpts{
+			Name:           "hpa_controller_cache_sync_seconds",
+			Help:           "Time taken to sync the informer caches when the hpa controller started",
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+	)
+
+	lastSuccessTimestamp = compbasemetrics.NewGauge(
+		&compbasemetrics.GaugeOpts{
+			Name:           "hpa_controller_last_success_timestamp_seconds",
+			Help:           "Timestamp of the last successful hpa reconcile, to alert on a stuck controller",
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+	)
+
+	annotationOpsTotal = compbasemetrics.NewCounterVec(
+		&compbasemetrics.CounterOpts{
+			Name:           "hpa_controller_annotation_ops_total",
+			Help:           "Counter of managed annotations added, updated or deleted on the hpas",
+			StabilityLevel: compbasemetrics.ALPHA,
+		},
+		[]string{"op"},
+	)
+
+	metricsList = []compbasemetrics.Registerable{
+		reconcileTotal,
+		reconcileDuration,
+		queueDepth,
+		droppedTotal,
+		lastSuccessTimestamp,
+		cacheSyncDuration,
+		annotationOpsTotal,
+	}
+)
+
+func init() {
+	registerMetrics()
+}
+
+func registerMetrics() {
+	for _, m := range metricsList {
+		metrics.MustRegister(m)
+	}
+}
+
+// observeAnnotationOps counts the managed annotations changed by an applied patch,
+// existing are the annotations of the hpa before the patch.
+func observeAnnotationOps(existing map[string]string, patch map[string]interface{}) {
+	for key, value := range patch {
+		if key == writtenAnnotationsAnnotation {
+			continue
+		}
+		_, ok := existing[key]
+		switch {
+		case value == nil:
+			annotationOpsTotal.WithLabelValues(opDelete).Inc()
+		case ok:
+			annotationOpsTotal.WithLabelValues(opUpdate).Inc()
+		default:
+			annotationOpsTotal.WithLabelValues(opAdd).Inc()
+		}
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/component-base/metrics/testutil"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestReconcileMetrics(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	successBefore, _ := testutil.GetCounterMetricValue(reconcileTotal.WithLabelValues(resultSuccess))
+	countBefore, _ := testutil.GetHistogramMetricCount(reconcileDuration.ObserverMetric)
+
+	f.controller.enqueueHPA(hpa)
+	if depth, _ := testutil.GetGaugeMetricValue(queueDepth); depth != 1 {
+		t.Errorf("expected queue depth 1, got %v", depth)
+	}
+
+	f.controller.processNextWorkItem(context.Background())
+
+	successAfter, err := testutil.GetCounterMetricValue(reconcileTotal.WithLabelValues(resultSuccess))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if successAfter-successBefore != 1 {
+		t.Errorf("expected success counter to increase by 1, got %v", successAfter-successBefore)
+	}
+
+	countAfter, err := testutil.GetHistogramMetricCount(reconcileDuration.ObserverMetric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countAfter-countBefore != 1 {
+		t.Errorf("expected 1 duration observation, got %v", countAfter-countBefore)
+	}
+
+	if depth, _ := testutil.GetGaugeMetricValue(queueDepth); depth != 0 {
+		t.Errorf("expected queue depth 0, got %v", depth)
+	}
+}
+
+func TestLastSuccessTimestampMetric(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	fakeClock := clocktesting.NewFakeClock(time.Date(2023, 3, 1, 8, 0, 0, 0, time.UTC))
+	f := newFixtureWithOptions(t, []Option{WithClock(fakeClock)}, hpa)
+
+	f.sync(hpa)
+	first, err := testutil.GetGaugeMetricValue(lastSuccessTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := float64(fakeClock.Now().Unix()); first != expected {
+		t.Errorf("expected the last success timestamp %v, got %v", expected, first)
+	}
+
+	fakeClock.Step(time.Minute)
+	f.sync(hpa)
+	second, err := testutil.GetGaugeMetricValue(lastSuccessTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second-first != time.Minute.Seconds() {
+		t.Errorf("expected the last success timestamp to advance by a minute, got %v", second-first)
+	}
+}
+
+func TestCacheSyncDurationMetric(t *testing.T) {
+	f := newFixture(t, newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80)))
+	// sentinel value, a sync duration is never negative
+	cacheSyncDuration.Set(-1)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.informers.Start(stopCh)
+
+	runStopCh := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- f.controller.Run(1, runStopCh)
+	}()
+	defer func() {
+		close(runStopCh)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return f.controller.Readyz(nil) == nil, nil
+	})
+	if err != nil {
+		t.Fatalf("caches didn't sync: %v", err)
+	}
+	duration, err := testutil.GetGaugeMetricValue(cacheSyncDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration < 0 || duration > wait.ForeverTestTimeout.Seconds() {
+		t.Errorf("expected the cache sync duration to be set, got %v", duration)
+	}
+}
+
+func TestDroppedMetric(t *testing.T) {
+	f := newFixtureWithOptions(t, []Option{WithMaxRetries(1)})
+
+	before, _ := testutil.GetCounterMetricValue(droppedTotal)
+
+	key := "default/test"
+	syncErr := fmt.Errorf("injected error")
+	f.controller.handleErr(syncErr, key)
+	if dropped, _ := testutil.GetCounterMetricValue(droppedTotal); dropped != before {
+		t.Fatalf("expected no drop before retries are exhausted, got %v", dropped-before)
+	}
+
+	f.controller.handleErr(syncErr, key)
+	after, err := testutil.GetCounterMetricValue(droppedTotal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after-before != 1 {
+		t.Errorf("expected dropped counter to increase by 1, got %v", after-before)
+	}
+}
+
+func TestAnnotationOpsMetric(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	ops := func() map[string]float64 {
+		counts := make(map[string]float64)
+		for _, op := range []string{opAdd, opUpdate, opDelete} {
+			counts[op], _ = testutil.GetCounterMetricValue(annotationOpsTotal.WithLabelValues(op))
+		}
+		return counts
+	}
+	update := func(metrics ...v2.MetricSpec) *v2.HorizontalPodAutoscaler {
+		got := f.get(hpa)
+		got.Spec.Metrics = metrics
+		got, err := f.kubeclient.AutoscalingV2().HorizontalPodAutoscalers(got.Namespace).Update(context.Background(), got, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.updateLister(got)
+		return got
+	}
+	expectOps := func(before map[string]float64, expected map[string]float64) {
+		t.Helper()
+		after := ops()
+		for op, count := range expected {
+			if delta := after[op] - before[op]; delta != count {
+				t.Errorf("expected %v %s ops, got %v", count, op, delta)
+			}
+		}
+	}
+
+	// cpuTargetUtilization, maxReplicas, metricCount, metricsSummary, minReplicas, replicaRange,
+	// scaleTargetRef
+	before := ops()
+	f.sync(hpa)
+	expectOps(before, map[string]float64{opAdd: 7, opUpdate: 0, opDelete: 0})
+
+	// cpuTargetUtilization and metricsSummary change
+	before = ops()
+	f.sync(update(resourceUtilizationMetric(v1.ResourceCPU, 60)))
+	expectOps(before, map[string]float64{opAdd: 0, opUpdate: 2, opDelete: 0})
+
+	// cpuTargetUtilization is pruned, memoryTargetValue added and metricsSummary changes
+	before = ops()
+	f.sync(update(resourceAverageValueMetric(v1.ResourceMemory, "512Mi")))
+	expectOps(before, map[string]float64{opAdd: 1, opUpdate: 1, opDelete: 1})
+
+	// nothing changes
+	before = ops()
+	f.sync(update(resourceAverageValueMetric(v1.ResourceMemory, "512Mi")))
+	expectOps(before, map[string]float64{opAdd: 0, opUpdate: 0, opDelete: 0})
+}
@@ -0,0 +1,394 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/scale"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	metricsclientset "k8s.io/metrics/pkg/client/clientset/versioned"
+	"k8s.io/utils/clock"
+)
+
+// Option configures the HPAController.
+type Option func(*HPAController)
+
+// WithWorkers sets the number of workers started by Start.
+func WithWorkers(workers int) Option {
+	return func(v *HPAController) {
+		v.Workers = workers
+	}
+}
+
+// WithWorkerLoopPeriod sets the period workers are restarted by Run after they returned.
+func WithWorkerLoopPeriod(period time.Duration) Option {
+	return func(v *HPAController) {
+		v.workerLoopPeriod = period
+	}
+}
+
+// WithMaxRetries sets the number of times a hpa will be retried before it is dropped out of the queue.
+func WithMaxRetries(maxRetries int) Option {
+	return func(v *HPAController) {
+		v.maxRetries = maxRetries
+	}
+}
+
+// WithFixedDelayRequeue requeues the hpas whose sync failed with an error matched by match after delay,
+// instead of the rate limited backoff, e.g. apierrors.IsNotFound to retry at a steady interval until
+// a missing object is created. The errors of the syncs match ErrConflict, ErrTransient or ErrInvalidSpec
+// with errors.Is, the invalid specs are never retried. The first matching option applies, and the fixed
+// delay requeues count towards the max retries like the rate limited ones.
+func WithFixedDelayRequeue(match func(error) bool, delay time.Duration) Option {
+	return func(v *HPAController) {
+		if match == nil || delay <= 0 {
+			v.errs = append(v.errs, fmt.Errorf("invalid fixed delay requeue: the matcher must be set and the delay %v positive", delay))
+			return
+		}
+		v.fixedDelays = append(v.fixedDelays, fixedDelayRequeue{match: match, delay: delay})
+	}
+}
+
+// WithShutdownTimeout bounds the time Run waits for the queue to drain on shutdown,
+// the in-flight syncs are canceled and Run returns once it's passed. The final flush of
+// the batched annotations is bounded by it as well. Defaults to 30s.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(v *HPAController) {
+		v.shutdownTimeout = timeout
+	}
+}
+
+// WithReconcileTimeout bounds the time spent syncing a single hpa.
+func WithReconcileTimeout(timeout time.Duration) Option {
+	return func(v *HPAController) {
+		v.reconcileTimeout = timeout
+	}
+}
+
+// WithResyncPeriod sets the period all hpas are periodically re-enqueued.
+func WithResyncPeriod(period time.Duration) Option {
+	return func(v *HPAController) {
+		v.resyncPeriod = period
+	}
+}
+
+// WithAnnotationPrefix sets the prefix of the annotation keys managed by the controller.
+func WithAnnotationPrefix(prefix string) Option {
+	return func(v *HPAController) {
+		v.annotationPrefix = prefix
+	}
+}
+
+// WithNamespace restricts the controller to the hpas in namespace.
+func WithNamespace(namespace string) Option {
+	return func(v *HPAController) {
+		v.namespace = namespace
+	}
+}
+
+// WithNamespaces restricts the controller to the hpas in the listed namespaces, empty means all namespaces.
+func WithNamespaces(namespaces []string) Option {
+	return func(v *HPAController) {
+		v.namespaces = sets.NewString(namespaces...)
+	}
+}
+
+// WithSelector restricts the controller to the hpas matching the label selector,
+// an invalid selector makes Run fail.
+func WithSelector(selector string) Option {
+	return func(v *HPAController) {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			v.errs = append(v.errs, fmt.Errorf("invalid selector %q: %v", selector, err))
+			return
+		}
+		v.selector = parsed
+	}
+}
+
+// WithLeaderElection enables leader election on a lease named lockName in namespace,
+// workers are started by Start only while this instance, identified by identity, is the leader.
+func WithLeaderElection(lockName, namespace, identity string) Option {
+	return func(v *HPAController) {
+		v.leaderElection = &leaderElectionConfig{
+			lockName:      lockName,
+			namespace:     namespace,
+			identity:      identity,
+			leaseDuration: defaultLeaseDuration,
+			renewDeadline: defaultRenewDeadline,
+			retryPeriod:   defaultRetryPeriod,
+		}
+	}
+}
+
+// WithTracer sets the tracer recording the reconcile spans, defaults to a no-op tracer.
+func WithTracer(tracer trace.Tracer) Option {
+	return func(v *HPAController) {
+		v.tracer = tracer
+	}
+}
+
+// WithTargetValidation checks the scale targets of the hpas exist and marks the hpas with missing targets.
+func WithTargetValidation() Option {
+	return func(v *HPAController) {
+		v.targetValidation = true
+	}
+}
+
+// WithDeadLetterHandler sets the handler called with the hpas dropped out of the queue after the max retries.
+func WithDeadLetterHandler(handler func(key string, err error)) Option {
+	return func(v *HPAController) {
+		v.deadLetterHandler = handler
+	}
+}
+
+// WithDryRun logs the annotations the controller would write instead of patching the hpas.
+func WithDryRun() Option {
+	return func(v *HPAController) {
+		v.dryRun = true
+	}
+}
+
+// WithPercentSuffix renders the utilization targets as e.g. 80% instead of the plain 80.
+func WithPercentSuffix() Option {
+	return func(v *HPAController) {
+		v.percentSuffix = true
+	}
+}
+
+// WithBatching coalesces the patches of the hpas within window,
+// they're flushed namespace by namespace with at most concurrency patches in flight.
+// A batched sync succeeds or fails, and is retried, once its patch is flushed.
+func WithBatching(window time.Duration, concurrency int) Option {
+	return func(v *HPAController) {
+		v.batcher = newPatchBatcher(window, concurrency)
+	}
+}
+
+// WithThrashDetection marks the hpas which scaled more than maxScales times within window.
+func WithThrashDetection(maxScales int, window time.Duration) Option {
+	return func(v *HPAController) {
+		v.thrash = newThrashDetector(maxScales, window)
+	}
+}
+
+// WithAnnotationEnricher merges the annotations returned by enricher into the managed annotations.
+// The managed annotations take precedence, the keys of enricher colliding with them are ignored.
+// The enriched annotations are removed once enricher stops returning them.
+func WithAnnotationEnricher(enricher func(*v2.HorizontalPodAutoscaler) map[string]string) Option {
+	return func(v *HPAController) {
+		v.enricher = enricher
+	}
+}
+
+// WithMaxInflightWrites caps the concurrent patches regardless of the number of workers,
+// defaults to the number of workers.
+func WithMaxInflightWrites(n int) Option {
+	return func(v *HPAController) {
+		v.maxInflightWrites = n
+	}
+}
+
+// WithRateLimiter sets the rate limiter computing the requeue delays of the failed hpas,
+// defaults to workqueue.DefaultControllerRateLimiter.
+func WithRateLimiter(rateLimiter workqueue.RateLimiter) Option {
+	return func(v *HPAController) {
+		v.rateLimiter = rateLimiter
+	}
+}
+
+// WithMetricsClient annotates the current usage of the pods of the scale targets read from the metrics API.
+func WithMetricsClient(client metricsclientset.Interface) Option {
+	return func(v *HPAController) {
+		v.metricsClient = client
+	}
+}
+
+// WithOptIn only syncs the hpas annotated with autoscaling.kubesphere.io/manage: "true",
+// by default all the hpas are synced but the ones annotated with "false".
+func WithOptIn() Option {
+	return func(v *HPAController) {
+		v.optIn = true
+	}
+}
+
+// WithScaleClient resolves the scale targets of any kind with a scale subresource, e.g. custom resources,
+// for the target validation and the usage annotations. Without it only the built-in workloads are resolved
+// and the targets of other kinds are assumed to exist.
+func WithScaleClient(scales scale.ScalesGetter, mapper meta.RESTMapper) Option {
+	return func(v *HPAController) {
+		v.scales = scales
+		v.restMapper = mapper
+	}
+}
+
+// WithChangeDetector sets a function deciding whether the annotations of a hpa need an update,
+// e.g. to ignore whitespace changes. It's called with the existing annotations of the hpa and the
+// desired managed ones, which it mustn't modify, and the hpa isn't patched if it returns false.
+// By default the annotations are compared key by key.
+func WithChangeDetector(detector func(existing, desired map[string]string) bool) Option {
+	return func(v *HPAController) {
+		v.changeDetector = detector
+	}
+}
+
+// WithEventCorrelatorOptions tunes the deduplication, the aggregation and the rate limiting of the events.
+// By default the client-go defaults apply: identical events are counted in a single event, more than 10
+// similar events within 10 minutes are aggregated and an hpa emits bursts of at most 25 events.
+func WithEventCorrelatorOptions(options record.CorrelatorOptions) Option {
+	return func(v *HPAController) {
+		v.eventCorrelatorOptions = options
+	}
+}
+
+// WithCleanupOnStop removes the managed annotations of all the hpas once the queue is drained on shutdown,
+// e.g. when the controller is uninstalled. The cleanup is bounded by the shutdown timeout too.
+func WithCleanupOnStop() Option {
+	return func(v *HPAController) {
+		v.cleanupOnStop = true
+	}
+}
+
+// WithCPURequest annotates the cpu request of a pod of the scale targets as cpuRequest, so the cpu
+// utilization targets can be interpreted. It reads the scale target of every synced hpa.
+func WithCPURequest() Option {
+	return func(v *HPAController) {
+		v.annotateCPURequest = true
+	}
+}
+
+// WithCPUTargetRange sets the recommended range of the cpu utilization targets, defaults to 10%-95%.
+// The hpas with cpu utilization targets outside of it are marked with a targetOutOfRange annotation.
+func WithCPUTargetRange(min, max int32) Option {
+	return func(v *HPAController) {
+		v.minCPUTarget = min
+		v.maxCPUTarget = max
+	}
+}
+
+// WithQueueName sets the name of the queue in the workqueue metrics, defaults to "hpa".
+// Each controller running in the same process needs its own name.
+func WithQueueName(name string) Option {
+	return func(v *HPAController) {
+		v.queueName = name
+	}
+}
+
+// WithSkippedOwners sets the kinds of the controllers whose hpas are left untouched,
+// defaults to the KEDA ScaledObjects. An empty list reconciles the hpas of any owner.
+func WithSkippedOwners(kinds ...schema.GroupKind) Option {
+	return func(v *HPAController) {
+		v.skippedOwners = kinds
+	}
+}
+
+// WithServerSideApply writes the annotations with server-side apply as the given field manager,
+// so the apiserver tracks the ownership of each managed annotation and resolves the conflicts
+// with the other writers of the hpa.
+func WithServerSideApply(fieldManager string) Option {
+	return func(v *HPAController) {
+		v.fieldManager = fieldManager
+	}
+}
+
+// WithMinSyncInterval syncs each hpa at most once per interval, the events of a hpa
+// received within the interval are coalesced into a single sync once it has passed.
+func WithMinSyncInterval(interval time.Duration) Option {
+	return func(v *HPAController) {
+		if interval > 0 {
+			v.syncInterval = newSyncInterval(interval)
+		}
+	}
+}
+
+// WithReconcileTimestamp annotates the hpas with the lastReconcileTime in RFC3339. To avoid
+// an update loop, the timestamp is only updated when the other annotations change.
+func WithReconcileTimestamp() Option {
+	return func(v *HPAController) {
+		v.reconcileTimestamp = true
+	}
+}
+
+// WithExcludedKeys sets the annotation keys which are never written nor pruned by the controller,
+// e.g. because another source populates them. The keys are matched with or without the prefix.
+func WithExcludedKeys(keys []string) Option {
+	return func(v *HPAController) {
+		v.excludedKeys = sets.NewString(keys...)
+	}
+}
+
+// WithDisabledResources skips the Resource and ContainerResource metrics of the listed resources,
+// e.g. v1.ResourceMemory to only annotate the cpu targets.
+func WithDisabledResources(resources ...v1.ResourceName) Option {
+	return func(v *HPAController) {
+		v.disabledResources = resources
+	}
+}
+
+// WithStatusAnnotations annotates the replica counts and the current metric values observed by the autoscaler.
+// They change on most of its status updates, about every 15s, and each change is another patch of the hpa,
+// so they're left out by default.
+func WithStatusAnnotations() Option {
+	return func(v *HPAController) {
+		v.statusAnnotations = true
+	}
+}
+
+// WithKeyTemplate renders the keys of the metric target annotations with a text/template
+// executed on KeyTemplateData, e.g. "metrics.kubesphere.io/{{.Key}}". The default keys are kept
+// without a template. Templates failing to render a valid annotation key for any metric source
+// type, or rendering the same key for different fields, are rejected.
+func WithKeyTemplate(text string) Option {
+	return func(v *HPAController) {
+		tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+		if err != nil {
+			v.errs = append(v.errs, fmt.Errorf("invalid key template %q: %v", text, err))
+			return
+		}
+		v.keyTemplate = tmpl
+	}
+}
+
+// WithClock sets the clock the controller reads the time from, the real clock by default.
+// Tests inject a fake clock to drive the resync, the delayed requeues and the time based detections deterministically.
+func WithClock(c clock.WithTicker) Option {
+	return func(v *HPAController) {
+		v.clock = c
+	}
+}
+
+// WithDefaultsConfigMap watches the ConfigMap namespace/name served by informer for the annotation defaults
+// changed at runtime: percentSuffix ("true" or "false") and disabledResources (e.g. "memory,storage").
+// The ConfigMap overrides WithPercentSuffix and WithDisabledResources, all the hpas are resynced when it
+// changes. The prior defaults are kept when it's malformed.
+func WithDefaultsConfigMap(informer coreinformers.ConfigMapInformer, namespace, name string) Option {
+	return func(v *HPAController) {
+		v.defaults = &configMapDefaults{namespace: namespace, name: name, informer: informer}
+	}
+}
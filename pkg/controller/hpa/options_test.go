@@ -0,0 +1,285 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"text/template"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+func newTestController(opts ...Option) *HPAController {
+	client := k8sfake.NewSimpleClientset()
+	informers := kubeinformers.NewSharedInformerFactory(client, 0)
+	return NewHPAController(informers.Autoscaling().V2().HorizontalPodAutoscalers(), client, opts...)
+}
+
+func TestWithWorkers(t *testing.T) {
+	if v := newTestController(); v.Workers != defaultWorkers {
+		t.Errorf("expected default workers %d, got %d", defaultWorkers, v.Workers)
+	}
+
+	if v := newTestController(WithWorkers(10)); v.Workers != 10 {
+		t.Errorf("expected 10 workers, got %d", v.Workers)
+	}
+
+	if v := newTestController(WithWorkers(0)); v.Workers != defaultWorkers {
+		t.Errorf("expected zero workers to default to %d, got %d", defaultWorkers, v.Workers)
+	}
+}
+
+func TestWithWorkerLoopPeriod(t *testing.T) {
+	if v := newTestController(); v.workerLoopPeriod != time.Second {
+		t.Errorf("expected default worker loop period %v, got %v", time.Second, v.workerLoopPeriod)
+	}
+
+	if v := newTestController(WithWorkerLoopPeriod(100 * time.Millisecond)); v.workerLoopPeriod != 100*time.Millisecond {
+		t.Errorf("expected worker loop period %v, got %v", 100*time.Millisecond, v.workerLoopPeriod)
+	}
+
+	fakeClock := newArmingClock()
+	v := newTestController(WithWorkerLoopPeriod(time.Minute), WithClock(fakeClock))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runs := make(chan struct{}, 10)
+	go v.until(ctx, func(context.Context) { runs <- struct{}{} })
+	expectRuns := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case <-runs:
+			case <-time.After(wait.ForeverTestTimeout):
+				t.Fatalf("expected the worker to be restarted")
+			}
+		}
+		select {
+		case <-runs:
+			t.Fatalf("expected the worker not to be restarted before the period")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	expectRuns(1)
+	for i := 1; i <= 2; i++ {
+		fakeClock.waitArmed(t, time.Minute, i)
+		fakeClock.Step(30 * time.Second)
+		expectRuns(0)
+		fakeClock.Step(30 * time.Second)
+		expectRuns(1)
+	}
+}
+
+func TestWithMaxRetries(t *testing.T) {
+	if v := newTestController(); v.maxRetries != defaultMaxRetries {
+		t.Errorf("expected default max retries %d, got %d", defaultMaxRetries, v.maxRetries)
+	}
+
+	v := newTestController(WithMaxRetries(2))
+	key := "default/test"
+	err := fmt.Errorf("injected error")
+
+	// the first failure and the following 2 retries
+	for i := 1; i <= 2; i++ {
+		v.handleErr(err, key)
+		if got := v.queue.NumRequeues(key); got != i {
+			t.Fatalf("expected %d requeues, got %d", i, got)
+		}
+	}
+
+	v.handleErr(err, key)
+	if got := v.queue.NumRequeues(key); got != 0 {
+		t.Errorf("expected key to be forgotten after 2 retries, got %d requeues", got)
+	}
+}
+
+func TestWithSelector(t *testing.T) {
+	v := newTestController(WithSelector("app=web"))
+	if v.selector == nil || v.selector.String() != "app=web" {
+		t.Errorf("expected selector app=web, got %v", v.selector)
+	}
+
+	v = newTestController(WithSelector("app in (web"))
+	if len(v.errs) != 1 {
+		t.Fatalf("expected invalid selector to be rejected, got %v", v.errs)
+	}
+	if err := v.Run(1, make(chan struct{})); err == nil {
+		t.Errorf("expected Run to fail with an invalid selector")
+	}
+}
+
+func TestWithResyncPeriod(t *testing.T) {
+	if v := newTestController(WithResyncPeriod(time.Minute)); v.resyncPeriod != time.Minute {
+		t.Errorf("expected resync period %v, got %v", time.Minute, v.resyncPeriod)
+	}
+}
+
+func TestWithAnnotationPrefix(t *testing.T) {
+	prefix := "autoscaling.kubesphere.io/"
+	if v := newTestController(WithAnnotationPrefix(prefix)); v.annotationPrefix != prefix {
+		t.Errorf("expected annotation prefix %q, got %q", prefix, v.annotationPrefix)
+	}
+}
+
+func TestWithPercentSuffix(t *testing.T) {
+	if v := newTestController(); v.percentSuffix {
+		t.Error("expected no percent suffix by default")
+	}
+	if v := newTestController(WithPercentSuffix()); !v.percentSuffix {
+		t.Error("expected percent suffix to be enabled")
+	}
+}
+
+func TestWithMaxInflightWrites(t *testing.T) {
+	if v := newTestController(WithWorkers(3)); cap(v.writes) != 3 {
+		t.Errorf("expected the inflight writes to default to the workers, got %d", cap(v.writes))
+	}
+	if v := newTestController(WithMaxInflightWrites(1)); cap(v.writes) != 1 {
+		t.Errorf("expected 1 inflight write, got %d", cap(v.writes))
+	}
+}
+
+// recordingRateLimiter records the delays computed by the wrapped rate limiter.
+type recordingRateLimiter struct {
+	workqueue.RateLimiter
+	delays []time.Duration
+}
+
+func (r *recordingRateLimiter) When(item interface{}) time.Duration {
+	delay := r.RateLimiter.When(item)
+	r.delays = append(r.delays, delay)
+	return delay
+}
+
+func TestWithRateLimiter(t *testing.T) {
+	limiter := &recordingRateLimiter{RateLimiter: workqueue.NewItemExponentialFailureRateLimiter(10*time.Millisecond, 40*time.Millisecond)}
+	v := newTestController(WithRateLimiter(limiter))
+	defer v.queue.ShutDown()
+
+	for i := 0; i < 4; i++ {
+		v.handleErr(fmt.Errorf("injected error"), "default/test")
+	}
+
+	expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond}
+	if !reflect.DeepEqual(limiter.delays, expected) {
+		t.Errorf("expected delays %v, got %v", expected, limiter.delays)
+	}
+	if requeues := v.queue.NumRequeues("default/test"); requeues != 4 {
+		t.Errorf("expected 4 requeues, got %d", requeues)
+	}
+
+	v.handleErr(nil, "default/test")
+	if requeues := v.queue.NumRequeues("default/test"); requeues != 0 {
+		t.Errorf("expected the requeues to be forgotten, got %d", requeues)
+	}
+}
+
+func TestWithQueueName(t *testing.T) {
+	v := newTestController(WithQueueName("hpa-shard-1"))
+	defer v.queue.ShutDown()
+	v.queue.Add("default/test")
+
+	// the workqueue metrics are registered by controller-runtime
+	families, err := ctrlmetrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "workqueue_adds_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "name" && label.GetValue() == "hpa-shard-1" {
+					return
+				}
+			}
+		}
+	}
+	t.Error("expected the workqueue metrics of a queue named hpa-shard-1")
+}
+
+func TestWithKeyTemplate(t *testing.T) {
+	v := newTestController(WithKeyTemplate("metrics.kubesphere.io/{{.Source}}.{{.Key}}"))
+	if len(v.errs) != 0 {
+		t.Fatalf("expected a valid key template, got %v", v.errs)
+	}
+
+	m := targetAnnotations(v.annotationOptions(), newHPA("test",
+		resourceUtilizationMetric(v1.ResourceCPU, 80),
+		resourceAverageValueMetric(v1.ResourceMemory, "512Mi")))
+	expected := map[string]string{
+		"metrics.kubesphere.io/Resource.cpuTargetUtilization": "80",
+		"metrics.kubesphere.io/Resource.memoryTargetValue":    "512Mi",
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, got %v", expected, m)
+	}
+}
+
+func TestWithKeyTemplateRejectsInvalidTemplates(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "parse error", opts: []Option{WithKeyTemplate("{{.Resource")}},
+		{name: "unknown field", opts: []Option{WithKeyTemplate("{{.Unknown}}")}},
+		{name: "invalid key", opts: []Option{WithKeyTemplate("metrics/{{.Resource}}/target")}},
+		{name: "invalid key for the Pods metrics", opts: []Option{WithKeyTemplate("{{.Resource}}-target")}},
+		{name: "same key for different fields", opts: []Option{WithKeyTemplate("{{.Source}}-target")}},
+		{name: "invalid key with prefix", opts: []Option{
+			WithKeyTemplate("metrics.kubesphere.io/{{.Resource}}"),
+			WithAnnotationPrefix("autoscaling.kubesphere.io/"),
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := newTestController(test.opts...)
+			if len(v.errs) != 1 {
+				t.Fatalf("expected the key template to be rejected, got %v", v.errs)
+			}
+			if v.keyTemplate != nil {
+				t.Errorf("expected the rejected key template not to be used")
+			}
+			if err := v.Run(1, make(chan struct{})); err == nil {
+				t.Errorf("expected Run to fail with an invalid key template")
+			}
+		})
+	}
+}
+
+func TestRenderKeyFallsBackToDefaultKey(t *testing.T) {
+	tmpl := template.Must(template.New("key").Parse("metrics.kubesphere.io/{{.Metric}}"))
+
+	if key := renderKey(tmpl, KeyTemplateData{Key: "podsMetric.rps", Metric: "rps"}); key != "metrics.kubesphere.io/rps" {
+		t.Errorf("expected the rendered key, got %q", key)
+	}
+	if key := renderKey(tmpl, KeyTemplateData{Key: "podsMetric.requests", Metric: "requests per second"}); key != "podsMetric.requests" {
+		t.Errorf("expected the default key for an invalid rendered key, got %q", key)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// cpuRequest returns the cpu request of a pod of the scale target, the sum of the cpu requests
+// of its containers, so the cpu utilization targets can be interpreted. The request is empty
+// when no container of the pod template requests cpu.
+func (v *HPAController) cpuRequest(ctx context.Context, hpa *v2.HorizontalPodAutoscaler) (string, error) {
+	template, err := v.targetPodTemplate(ctx, hpa)
+	if err != nil {
+		return "", err
+	}
+	if template == nil {
+		return "", nil
+	}
+
+	request := resource.NewMilliQuantity(0, resource.DecimalSI)
+	for _, container := range template.Spec.Containers {
+		if cpu, ok := container.Resources.Requests[v1.ResourceCPU]; ok {
+			request.Add(cpu)
+		}
+	}
+	if request.IsZero() {
+		return "", nil
+	}
+	return request.String(), nil
+}
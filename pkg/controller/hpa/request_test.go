@@ -0,0 +1,103 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newDeployment(name string, cpuRequests ...string) *appsv1.Deployment {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceDefault},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+		},
+	}
+	for _, request := range cpuRequests {
+		deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, v1.Container{
+			Name: "app",
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse(request)},
+			},
+		})
+	}
+	return deployment
+}
+
+func TestSyncAnnotatesCPURequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		deployment *appsv1.Deployment
+		expected   string
+	}{
+		{name: "single container", deployment: newDeployment("test", "250m"), expected: "250m"},
+		{name: "sidecar", deployment: newDeployment("test", "250m", "1"), expected: "1250m"},
+		{name: "no requests", deployment: newDeployment("test"), expected: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+			f := newFixtureWithOptions(t, []Option{WithCPURequest()}, hpa)
+			if err := f.kubeclient.Tracker().Add(test.deployment); err != nil {
+				t.Fatal(err)
+			}
+
+			f.sync(hpa)
+
+			if got := f.get(hpa).Annotations["cpuRequest"]; got != test.expected {
+				t.Errorf("expected cpuRequest %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSyncWithoutCPURequest(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+	if err := f.kubeclient.Tracker().Add(newDeployment("test", "250m")); err != nil {
+		t.Fatal(err)
+	}
+
+	f.sync(hpa)
+
+	for _, action := range f.kubeclient.Actions() {
+		if action.Matches("get", "deployments") {
+			t.Errorf("expected the scale target not to be read without WithCPURequest")
+		}
+	}
+	if got, ok := f.get(hpa).Annotations["cpuRequest"]; ok {
+		t.Errorf("expected no cpuRequest annotation, got %q", got)
+	}
+}
+
+func TestSyncKeepsCPURequestWhenTargetMissing(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	hpa.Annotations = map[string]string{"cpuRequest": "250m"}
+	f := newFixtureWithOptions(t, []Option{WithCPURequest()}, hpa)
+
+	f.sync(hpa)
+
+	if got := f.get(hpa).Annotations["cpuRequest"]; got != "250m" {
+		t.Errorf("expected the last known cpuRequest to be kept, got %q", got)
+	}
+}
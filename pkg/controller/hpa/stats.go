@@ -0,0 +1,79 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ControllerStats is a snapshot of the state of the HPAController.
+type ControllerStats struct {
+	// QueueLength is the number of hpas waiting to be synced.
+	QueueLength int
+	// Processed is the number of syncs since the controller was created.
+	Processed int64
+	// Errors is the number of failed syncs since the controller was created.
+	Errors int64
+	// Retries are the number of times the hpas currently being retried have been requeued, keyed by hpa.
+	Retries map[string]int
+}
+
+// controllerStats records the syncs of the HPAController.
+type controllerStats struct {
+	processed atomic.Int64
+	errors    atomic.Int64
+
+	lock    sync.Mutex
+	retries map[string]int
+}
+
+func newControllerStats() *controllerStats {
+	return &controllerStats{retries: make(map[string]int)}
+}
+
+func (s *controllerStats) observe(key string, err error, requeues int) {
+	s.processed.Add(1)
+	if err != nil {
+		s.errors.Add(1)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if requeues > 0 {
+		s.retries[key] = requeues
+	} else {
+		delete(s.retries, key)
+	}
+}
+
+// Stats returns a snapshot of the queue and the syncs of the controller.
+func (v *HPAController) Stats() ControllerStats {
+	v.stats.lock.Lock()
+	retries := make(map[string]int, len(v.stats.retries))
+	for key, requeues := range v.stats.retries {
+		retries[key] = requeues
+	}
+	v.stats.lock.Unlock()
+
+	return ControllerStats{
+		QueueLength: v.queue.Len(),
+		Processed:   v.stats.processed.Load(),
+		Errors:      v.stats.errors.Load(),
+		Retries:     retries,
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/testing"
+)
+
+func TestStats(t *testing.T) {
+	good := newHPA("good", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	bad := newHPA("bad", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, good, bad)
+	f.kubeclient.PrependReactor("patch", "horizontalpodautoscalers", func(action core.Action) (bool, runtime.Object, error) {
+		if action.(core.PatchAction).GetName() == bad.Name {
+			return true, nil, fmt.Errorf("injected error")
+		}
+		return false, nil, nil
+	})
+
+	f.controller.enqueueHPA(good)
+	f.controller.enqueueHPA(bad)
+	if stats := f.controller.Stats(); stats.QueueLength != 2 {
+		t.Errorf("expected queue length 2, got %d", stats.QueueLength)
+	}
+
+	f.controller.processNextWorkItem(context.Background())
+	f.controller.processNextWorkItem(context.Background())
+
+	stats := f.controller.Stats()
+	if stats.Processed != 2 {
+		t.Errorf("expected 2 processed, got %d", stats.Processed)
+	}
+	if stats.Errors != 1 {
+		t.Errorf("expected 1 error, got %d", stats.Errors)
+	}
+	if expected := map[string]int{"default/bad": 1}; !reflect.DeepEqual(stats.Retries, expected) {
+		t.Errorf("expected retries %v, got %v", expected, stats.Retries)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v2 "k8s.io/api/autoscaling/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// errUnknownTargetKind is returned when the kind of the scale target isn't known.
+var errUnknownTargetKind = fmt.Errorf("unknown scale target kind")
+
+// targetExists returns false if the scale target of the hpa doesn't exist,
+// the targets of the kinds it doesn't know are assumed to exist.
+func (v *HPAController) targetExists(ctx context.Context, hpa *v2.HorizontalPodAutoscaler) (bool, error) {
+	_, err := v.targetSelector(ctx, hpa)
+	if err == errUnknownTargetKind {
+		return true, nil
+	}
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// targetSelector resolves the scale target of the hpa and returns the selector of its pods,
+// labels.Nothing() for the targets without a selector, see selectsPods before listing with it.
+func (v *HPAController) targetSelector(ctx context.Context, hpa *v2.HorizontalPodAutoscaler) (labels.Selector, error) {
+	selector, _, err := v.scaleTarget(ctx, hpa)
+	return selector, err
+}
+
+// targetPodTemplate resolves the scale target of the hpa and returns the template of its pods.
+func (v *HPAController) targetPodTemplate(ctx context.Context, hpa *v2.HorizontalPodAutoscaler) (*v1.PodTemplateSpec, error) {
+	_, template, err := v.scaleTarget(ctx, hpa)
+	return template, err
+}
+
+// scaleSelector resolves the scale target of the kinds without typed clients, e.g. custom resources,
+// through their scale subresource and returns the selector of its pods.
+func (v *HPAController) scaleSelector(ctx context.Context, namespace string, gk schema.GroupKind, version, name string) (labels.Selector, error) {
+	if v.scales == nil {
+		return nil, errUnknownTargetKind
+	}
+	mapping, err := v.restMapper.RESTMapping(gk, version)
+	if meta.IsNoMatchError(err) {
+		return nil, errUnknownTargetKind
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scale, err := v.scales.Scales(namespace).Get(ctx, mapping.Resource.GroupResource(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// the scale subresource of the resources without a label selector path has no selector
+	if scale.Status.Selector == "" {
+		return labels.Nothing(), nil
+	}
+	return labels.Parse(scale.Status.Selector)
+}
+
+// scaleTarget resolves the scale target of the hpa and returns the selector and the template of its pods,
+// the template is nil for the kinds resolved through the scale subresource.
+func (v *HPAController) scaleTarget(ctx context.Context, hpa *v2.HorizontalPodAutoscaler) (labels.Selector, *v1.PodTemplateSpec, error) {
+	ref := hpa.Spec.ScaleTargetRef
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var selector *metav1.LabelSelector
+	var template *v1.PodTemplateSpec
+	switch (schema.GroupKind{Group: gv.Group, Kind: ref.Kind}) {
+	case appsv1.SchemeGroupVersion.WithKind("Deployment").GroupKind():
+		deployment, err := v.client.AppsV1().Deployments(hpa.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		selector, template = deployment.Spec.Selector, &deployment.Spec.Template
+	case appsv1.SchemeGroupVersion.WithKind("StatefulSet").GroupKind():
+		statefulSet, err := v.client.AppsV1().StatefulSets(hpa.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		selector, template = statefulSet.Spec.Selector, &statefulSet.Spec.Template
+	case appsv1.SchemeGroupVersion.WithKind("ReplicaSet").GroupKind():
+		replicaSet, err := v.client.AppsV1().ReplicaSets(hpa.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		selector, template = replicaSet.Spec.Selector, &replicaSet.Spec.Template
+	case v1.SchemeGroupVersion.WithKind("ReplicationController").GroupKind():
+		rc, err := v.client.CoreV1().ReplicationControllers(hpa.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return labels.SelectorFromSet(rc.Spec.Selector), rc.Spec.Template, nil
+	default:
+		selector, err := v.scaleSelector(ctx, hpa.Namespace, schema.GroupKind{Group: gv.Group, Kind: ref.Kind}, gv.Version, ref.Name)
+		return selector, nil, err
+	}
+
+	if selector == nil {
+		return labels.Nothing(), template, nil
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	return s, template, err
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/scale"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeScales serves the scale subresources keyed by resource and name.
+type fakeScales map[schema.GroupResource]map[string]*autoscalingv1.Scale
+
+func (f fakeScales) Scales(namespace string) scale.ScaleInterface {
+	return f
+}
+
+func (f fakeScales) Get(ctx context.Context, resource schema.GroupResource, name string, opts metav1.GetOptions) (*autoscalingv1.Scale, error) {
+	if s, ok := f[resource][name]; ok {
+		return s, nil
+	}
+	return nil, apierrors.NewNotFound(resource, name)
+}
+
+func (f fakeScales) Update(ctx context.Context, resource schema.GroupResource, s *autoscalingv1.Scale, opts metav1.UpdateOptions) (*autoscalingv1.Scale, error) {
+	return nil, apierrors.NewMethodNotSupported(resource, "update")
+}
+
+func (f fakeScales) Patch(ctx context.Context, gvr schema.GroupVersionResource, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) (*autoscalingv1.Scale, error) {
+	return nil, apierrors.NewMethodNotSupported(gvr.GroupResource(), "patch")
+}
+
+func TestSyncValidatesTarget(t *testing.T) {
+	tests := []struct {
+		name          string
+		targetPresent bool
+	}{
+		{name: "target present", targetPresent: true},
+		{name: "target missing", targetPresent: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+			f := newFixtureWithOptions(t, []Option{WithTargetValidation()}, hpa)
+			recorder := record.NewFakeRecorder(10)
+			f.controller.recorder = recorder
+			if test.targetPresent {
+				deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: hpa.Spec.ScaleTargetRef.Name, Namespace: hpa.Namespace}}
+				if _, err := f.kubeclient.AppsV1().Deployments(hpa.Namespace).Create(context.Background(), deployment, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			f.sync(hpa)
+
+			got := f.get(hpa)
+			if test.targetPresent {
+				if _, ok := got.Annotations["targetMissing"]; ok {
+					t.Errorf("expected no targetMissing annotation, got %v", got.Annotations)
+				}
+				expectEvent(t, recorder, v1.EventTypeNormal, annotatedMetrics)
+				return
+			}
+			if got.Annotations["targetMissing"] != "true" {
+				t.Errorf("expected targetMissing annotation, got %v", got.Annotations)
+			}
+			expectEvent(t, recorder, v1.EventTypeWarning, targetNotFound)
+		})
+	}
+}
+
+func TestSyncSkipsTargetValidationByDefault(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixture(t, hpa)
+
+	f.sync(hpa)
+
+	for _, action := range f.kubeclient.Actions() {
+		if action.GetResource().Resource == "deployments" {
+			t.Errorf("expected no deployment lookups, got %v", action)
+		}
+	}
+	if _, ok := f.get(hpa).Annotations["targetMissing"]; ok {
+		t.Error("expected no targetMissing annotation without target validation")
+	}
+}
+
+func TestScaleTargetResolvesCustomResources(t *testing.T) {
+	gv := schema.GroupVersion{Group: "example.kubesphere.io", Version: "v1"}
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gv})
+	mapper.Add(gv.WithKind("Worker"), meta.RESTScopeNamespace)
+	scales := fakeScales{
+		gv.WithResource("workers").GroupResource(): {
+			"test": {
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: metav1.NamespaceDefault},
+				Status:     autoscalingv1.ScaleStatus{Replicas: 2, Selector: "app=test"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		kind     string
+		target   string
+		exists   bool
+		selector string
+	}{
+		{name: "custom resource", kind: "Worker", target: "test", exists: true, selector: "app=test"},
+		{name: "missing custom resource", kind: "Worker", target: "missing"},
+		{name: "unmapped kind", kind: "Unknown", target: "test", exists: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+			hpa.Spec.ScaleTargetRef.APIVersion = gv.String()
+			hpa.Spec.ScaleTargetRef.Kind = test.kind
+			hpa.Spec.ScaleTargetRef.Name = test.target
+			f := newFixtureWithOptions(t, []Option{WithTargetValidation(), WithScaleClient(scales, mapper)}, hpa)
+
+			exists, err := f.controller.targetExists(context.Background(), hpa)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if exists != test.exists {
+				t.Errorf("expected the target to exist %v, got %v", test.exists, exists)
+			}
+			if test.selector != "" {
+				selector, err := f.controller.targetSelector(context.Background(), hpa)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got := selector.String(); got != test.selector {
+					t.Errorf("expected the selector %q, got %q", test.selector, got)
+				}
+			}
+
+			f.sync(hpa)
+			if _, ok := f.get(hpa).Annotations["targetMissing"]; ok == test.exists {
+				t.Errorf("expected targetMissing %v, got %v", !test.exists, f.get(hpa).Annotations)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"sync"
+	"time"
+)
+
+// thrashDetector remembers the recent scale times of the hpas, a hpa is thrashing
+// when it scaled more than maxScales times within window.
+type thrashDetector struct {
+	sync.Mutex
+	maxScales int
+	window    time.Duration
+
+	histories map[string]*scaleHistory
+	// lastEviction is the last time the hpas not seen within window were forgotten.
+	lastEviction time.Time
+}
+
+// scaleHistory is a ring buffer of the last maxScales+1 scale times of a hpa.
+type scaleHistory struct {
+	times    []time.Time
+	next     int
+	lastSeen time.Time
+}
+
+func newThrashDetector(maxScales int, window time.Duration) *thrashDetector {
+	if maxScales < 1 {
+		maxScales = 1
+	}
+	return &thrashDetector{
+		maxScales: maxScales,
+		window:    window,
+		histories: make(map[string]*scaleHistory),
+	}
+}
+
+// observe records the last scale time of the hpa if it's a new one, and returns true if the hpa is thrashing.
+func (d *thrashDetector) observe(key string, lastScaleTime, now time.Time) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	d.evict(now)
+
+	history, ok := d.histories[key]
+	if !ok {
+		history = &scaleHistory{times: make([]time.Time, 0, d.maxScales+1)}
+		d.histories[key] = history
+	}
+	history.lastSeen = now
+	history.add(lastScaleTime)
+
+	// the buffer holds maxScales+1 times, the hpa is thrashing if the oldest one is within the window
+	if len(history.times) <= d.maxScales {
+		return false
+	}
+	return now.Sub(history.oldest()) <= d.window
+}
+
+func (d *thrashDetector) forget(key string) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.histories, key)
+}
+
+// evict forgets the hpas not seen within window, their scale times are too old to matter.
+// It runs at most once per window to keep observe cheap.
+func (d *thrashDetector) evict(now time.Time) {
+	if now.Sub(d.lastEviction) < d.window {
+		return
+	}
+	d.lastEviction = now
+
+	for key, history := range d.histories {
+		if now.Sub(history.lastSeen) > d.window {
+			delete(d.histories, key)
+		}
+	}
+}
+
+func (h *scaleHistory) add(t time.Time) {
+	if len(h.times) > 0 && h.newest().Equal(t) {
+		return
+	}
+	if len(h.times) < cap(h.times) {
+		h.times = append(h.times, t)
+		return
+	}
+	h.times[h.next] = t
+	h.next = (h.next + 1) % len(h.times)
+}
+
+func (h *scaleHistory) oldest() time.Time {
+	if len(h.times) < cap(h.times) {
+		return h.times[0]
+	}
+	return h.times[h.next]
+}
+
+func (h *scaleHistory) newest() time.Time {
+	if len(h.times) < cap(h.times) {
+		return h.times[len(h.times)-1]
+	}
+	return h.times[(h.next+len(h.times)-1)%len(h.times)]
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestSyncDetectsScalingThrash(t *testing.T) {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithThrashDetection(3, 10*time.Minute)}, hpa)
+	fakeClock := clocktesting.NewFakeClock(time.Date(2023, 3, 1, 8, 0, 0, 0, time.UTC))
+	f.controller.clock = fakeClock
+	recorder := record.NewFakeRecorder(100)
+	f.controller.recorder = recorder
+
+	scale := func() {
+		fakeClock.Step(time.Minute)
+		got := f.get(hpa)
+		lastScaleTime := metav1.NewTime(fakeClock.Now())
+		got.Status.LastScaleTime = &lastScaleTime
+		f.updateLister(got)
+		f.sync(got)
+	}
+
+	for i := 0; i < 3; i++ {
+		scale()
+		if got := f.get(hpa); got.Annotations["scalingThrash"] != "" {
+			t.Fatalf("expected no thrash after %d scales, got %v", i+1, got.Annotations)
+		}
+	}
+
+	scale()
+	if got := f.get(hpa); got.Annotations["scalingThrash"] != "true" {
+		t.Fatalf("expected thrash after 4 scales, got %v", got.Annotations)
+	}
+	events := 0
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.HasPrefix(event, v1.EventTypeWarning+" "+scalingThrash+" ") {
+			events++
+		}
+	}
+	if events != 1 {
+		t.Errorf("expected 1 %s event, got %d", scalingThrash, events)
+	}
+
+	// no scale for a while, the hpa calms down
+	fakeClock.Step(time.Hour)
+	got := f.get(hpa)
+	f.updateLister(got)
+	f.sync(got)
+	if got := f.get(hpa); got.Annotations["scalingThrash"] != "" {
+		t.Errorf("expected thrash to be cleared, got %v", got.Annotations)
+	}
+}
+
+func TestThrashDetectorEvictsStaleHPAs(t *testing.T) {
+	d := newThrashDetector(2, time.Minute)
+	now := time.Date(2023, 3, 1, 8, 0, 0, 0, time.UTC)
+
+	d.observe("default/a", now, now)
+	d.observe("default/b", now, now)
+
+	now = now.Add(2 * time.Minute)
+	d.observe("default/b", now, now)
+
+	if _, ok := d.histories["default/a"]; ok {
+		t.Error("expected hpa not seen within the window to be evicted")
+	}
+	if _, ok := d.histories["default/b"]; !ok {
+		t.Error("expected recently seen hpa to be kept")
+	}
+}
+
+func TestScaleHistoryRingBuffer(t *testing.T) {
+	d := newThrashDetector(2, time.Hour)
+	start := time.Date(2023, 3, 1, 8, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 10; i++ {
+		d.observe("default/test", start.Add(time.Duration(i)*time.Minute), start.Add(10*time.Minute))
+	}
+
+	history := d.histories["default/test"]
+	if len(history.times) != 3 {
+		t.Fatalf("expected the buffer to hold 3 times, got %d", len(history.times))
+	}
+	if oldest := history.oldest(); !oldest.Equal(start.Add(7 * time.Minute)) {
+		t.Errorf("expected oldest scale time %v, got %v", start.Add(7*time.Minute), oldest)
+	}
+	if newest := history.newest(); !newest.Equal(start.Add(9 * time.Minute)) {
+		t.Errorf("expected newest scale time %v, got %v", start.Add(9*time.Minute), newest)
+	}
+}
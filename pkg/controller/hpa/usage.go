@@ -0,0 +1,95 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"strconv"
+
+	v2 "k8s.io/api/autoscaling/v2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// usageAnnotationKeys are the annotations of the current usage, they're kept as is when the metrics API is unavailable.
+var usageAnnotationKeys = []string{"cpuCurrentUtilization", "memoryCurrentUsage"}
+
+// usageAnnotations returns the current usage of the pods of the scale target read from the metrics API:
+// the cpu usage relative to the cpu requests, and the average memory usage. No usage is annotated for the
+// targets without a selector.
+func (v *HPAController) usageAnnotations(ctx context.Context, hpa *v2.HorizontalPodAutoscaler) (map[string]string, error) {
+	selector, err := v.targetSelector(ctx, hpa)
+	if err != nil {
+		return nil, err
+	}
+	if !selectsPods(selector) {
+		return map[string]string{}, nil
+	}
+	options := metav1.ListOptions{LabelSelector: selector.String()}
+
+	podMetrics, err := v.metricsClient.MetricsV1beta1().PodMetricses(hpa.Namespace).List(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	if len(podMetrics.Items) == 0 {
+		return m, nil
+	}
+
+	pods, err := v.client.CoreV1().Pods(hpa.Namespace).List(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	cpuRequests := make(map[string]int64, len(pods.Items))
+	for _, pod := range pods.Items {
+		var request int64
+		for _, container := range pod.Spec.Containers {
+			request += container.Resources.Requests.Cpu().MilliValue()
+		}
+		cpuRequests[pod.Name] = request
+	}
+
+	var cpuUsage, cpuRequest, memoryUsage int64
+	for _, pod := range podMetrics.Items {
+		var podCPUUsage int64
+		for _, container := range pod.Containers {
+			podCPUUsage += container.Usage.Cpu().MilliValue()
+			memoryUsage += container.Usage.Memory().Value()
+		}
+		// the pods without cpu requests can't count towards the utilization
+		if request := cpuRequests[pod.Name]; request > 0 {
+			cpuUsage += podCPUUsage
+			cpuRequest += request
+		}
+	}
+
+	if cpuRequest > 0 {
+		m["cpuCurrentUtilization"] = strconv.FormatInt(cpuUsage*100/cpuRequest, 10)
+	}
+	m["memoryCurrentUsage"] = resource.NewQuantity(memoryUsage/int64(len(podMetrics.Items)), resource.BinarySI).String()
+	return m, nil
+}
+
+// selectsPods returns false for the selectors matching no pod, or all the pods of the namespace, both
+// render an empty list selector.
+func selectsPods(selector labels.Selector) bool {
+	if _, selectable := selector.Requirements(); !selectable {
+		return false
+	}
+	return !selector.Empty()
+}
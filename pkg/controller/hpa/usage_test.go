@@ -0,0 +1,183 @@
+/*
+Copyright 2023 The KubeSphere Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hpa
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/testing"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsfake "k8s.io/metrics/pkg/client/clientset/versioned/fake"
+)
+
+func newPod(name, cpuRequest string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceDefault, Labels: map[string]string{"app": "test"}},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name: "app",
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpuRequest)},
+				},
+			}},
+		},
+	}
+}
+
+func newPodMetrics(name, cpu, memory string) *metricsv1beta1.PodMetrics {
+	return &metricsv1beta1.PodMetrics{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceDefault, Labels: map[string]string{"app": "test"}},
+		Containers: []metricsv1beta1.ContainerMetrics{{
+			Name: "app",
+			Usage: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse(cpu),
+				v1.ResourceMemory: resource.MustParse(memory),
+			},
+		}},
+	}
+}
+
+func newUsageFixture(t *testing.T, metricsClient *metricsfake.Clientset) *fixture {
+	hpa := newHPA("test", resourceUtilizationMetric(v1.ResourceCPU, 80))
+	f := newFixtureWithOptions(t, []Option{WithMetricsClient(metricsClient)}, hpa)
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: metav1.NamespaceDefault},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}},
+		},
+	}
+	objects := []runtime.Object{deployment, newPod("test-1", "200m"), newPod("test-2", "200m")}
+	other := newPod("other", "100m")
+	other.Labels = map[string]string{"app": "other"}
+	objects = append(objects, other)
+	for _, obj := range objects {
+		if err := f.kubeclient.Tracker().Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+func TestSyncAnnotatesCurrentUsage(t *testing.T) {
+	other := newPodMetrics("other", "1", "1Gi")
+	other.Labels = map[string]string{"app": "other"}
+	metricsClient := metricsfake.NewSimpleClientset()
+	// the fake client serves the pod metrics as the "pods" resource
+	gvr := metricsv1beta1.SchemeGroupVersion.WithResource("pods")
+	for _, podMetrics := range []*metricsv1beta1.PodMetrics{newPodMetrics("test-1", "100m", "256Mi"), newPodMetrics("test-2", "200m", "768Mi"), other} {
+		if err := metricsClient.Tracker().Create(gvr, podMetrics, podMetrics.Namespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := newUsageFixture(t, metricsClient)
+	hpa := newHPA("test")
+
+	f.sync(hpa)
+
+	got := f.get(hpa)
+	if got.Annotations["cpuCurrentUtilization"] != "75" {
+		t.Errorf("expected cpuCurrentUtilization 75, got %v", got.Annotations)
+	}
+	if got.Annotations["memoryCurrentUsage"] != "512Mi" {
+		t.Errorf("expected memoryCurrentUsage 512Mi, got %v", got.Annotations)
+	}
+}
+
+func TestSyncKeepsUsageWhenMetricsUnavailable(t *testing.T) {
+	metricsClient := metricsfake.NewSimpleClientset()
+	metricsClient.PrependReactor("list", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("the server is currently unable to handle the request")
+	})
+	f := newUsageFixture(t, metricsClient)
+	hpa := f.get(newHPA("test"))
+	hpa.Annotations = map[string]string{"cpuCurrentUtilization": "60", "memoryCurrentUsage": "1Gi"}
+	hpa, err := f.kubeclient.AutoscalingV2().HorizontalPodAutoscalers(hpa.Namespace).Update(context.Background(), hpa, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.updateLister(hpa)
+
+	f.sync(hpa)
+
+	got := f.get(hpa)
+	if got.Annotations["cpuTargetUtilization"] != "80" {
+		t.Errorf("expected the targets to be annotated, got %v", got.Annotations)
+	}
+	if got.Annotations["cpuCurrentUtilization"] != "60" || got.Annotations["memoryCurrentUsage"] != "1Gi" {
+		t.Errorf("expected the last known usage to be kept, got %v", got.Annotations)
+	}
+}
+
+func TestSyncSkipsUsageWithoutSelector(t *testing.T) {
+	metricsClient := metricsfake.NewSimpleClientset()
+	gvr := metricsv1beta1.SchemeGroupVersion.WithResource("pods")
+	podMetrics := newPodMetrics("test-1", "100m", "256Mi")
+	if err := metricsClient.Tracker().Create(gvr, podMetrics, podMetrics.Namespace); err != nil {
+		t.Fatal(err)
+	}
+	f := newUsageFixture(t, metricsClient)
+	deployment, err := f.kubeclient.AppsV1().Deployments(metav1.NamespaceDefault).Get(context.Background(), "test", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment.Spec.Selector = nil
+	if err := f.kubeclient.Tracker().Update(appsv1.SchemeGroupVersion.WithResource("deployments"), deployment, deployment.Namespace); err != nil {
+		t.Fatal(err)
+	}
+	hpa := newHPA("test")
+
+	f.sync(hpa)
+
+	got := f.get(hpa)
+	for _, key := range usageAnnotationKeys {
+		if _, ok := got.Annotations[key]; ok {
+			t.Errorf("expected no %s without a selector, got %v", key, got.Annotations)
+		}
+	}
+	if actions := metricsClient.Actions(); len(actions) != 0 {
+		t.Errorf("expected the pod metrics not to be listed without a selector, got %v", actions)
+	}
+}
+
+func TestSelectsPods(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector labels.Selector
+		expected bool
+	}{
+		{name: "nothing", selector: labels.Nothing(), expected: false},
+		{name: "everything", selector: labels.Everything(), expected: false},
+		{name: "labels", selector: labels.SelectorFromSet(labels.Set{"app": "test"}), expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := selectsPods(test.selector); got != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}